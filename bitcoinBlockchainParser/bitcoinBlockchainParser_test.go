@@ -0,0 +1,133 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "path"
+  "reflect"
+  "testing"
+)
+
+func TestCollectBlockInfoLeavesIncompleteRecords(t *testing.T) {
+  directory := t.TempDir()
+  block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, []byte{0x51}))
+  block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 50, []byte{0x51}))
+  record1 := testRecord(t, block1)
+  record2 := testRecord(t, block2)
+
+  // bitcoind wrote the magic of block 2 into the preallocated file, but not
+  // its size yet
+  preallocated := make([]byte, len(record1)+len(record2)+4096)
+  copy(preallocated, record1)
+  copy(preallocated[len(record1):], record2[0:4])
+  writeTestFile(t, directory, "blk00000.dat", nil, preallocated)
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  reporter := new(testReporter)
+  options := newTestParserOptions()
+  options.Progress = reporter
+  options.HeaderCache = path.Join(t.TempDir(), "headers")
+
+  collect := func(expected int) {
+    blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = bc.FindChains(blockMap, blockOrder, options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(blockOrder) != expected {
+      t.Fatalf("found %d blocks, expected %d", len(blockOrder), expected)
+    }
+    for _, event := range reporter.events {
+      if skipped, ok := event.(SkippedRegionEvent); ok {
+        t.Fatalf("reported %+v", skipped)
+      }
+    }
+  }
+  collect(1)
+
+  // the rest of the record is written, the next scan finds it
+  copy(preallocated[len(record1):], record2)
+  writeTestFile(t, directory, "blk00000.dat", nil, preallocated)
+  collect(2)
+}
+
+func TestCollectBlockInfoSkipsGarbageBetweenRecords(t *testing.T) {
+  directory := t.TempDir()
+  block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, []byte{0x51}))
+  block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 50, []byte{0x51}))
+  block3 := newTestBlock(t, block2.BlockHash(), 1500001200, newTestCoinbase(3, 50, []byte{0x51}))
+  record2 := testRecord(t, block2)
+  record3 := testRecord(t, block3)
+
+  // garbage starting like a magic, long enough for the magic of block 3 to
+  // span two chunks of the search
+  garbage := bytes.Repeat([]byte{0xaa}, 64*1024-2)
+  copy(garbage, record2[0:2])
+  writeTestFile(t, directory, "blk00000.dat", nil, testRecord(t, block1))
+  writeTestFile(t, directory, "blk00001.dat", nil, bytes.Join([][]byte{record2, garbage, record3}, nil))
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  reporter := new(testReporter)
+  options := newTestParserOptions()
+  options.Progress = reporter
+  var skippedRegions []*SkippedRegionError
+  options.OnSkippedRegion = func(skippedRegion *SkippedRegionError) error {
+    skippedRegions = append(skippedRegions, skippedRegion)
+    return nil
+  }
+
+  _, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(blockOrder) != 3 {
+    t.Fatalf("found %d blocks, expected 3", len(blockOrder))
+  }
+  if blockOrder[2].Hash != testHash(block3) || blockOrder[2].BlkFileNumber != 1 || blockOrder[2].BlkFilePosition != int32(len(record2)+len(garbage)) {
+    t.Errorf("found block 3 at %d:%d", blockOrder[2].BlkFileNumber, blockOrder[2].BlkFilePosition)
+  }
+
+  var events []SkippedRegionEvent
+  for _, event := range reporter.events {
+    if skipped, ok := event.(SkippedRegionEvent); ok {
+      events = append(events, skipped)
+    }
+  }
+  if len(events) != 1 || len(skippedRegions) != 1 {
+    t.Fatalf("reported %+v, called back %d times", events, len(skippedRegions))
+  }
+  expected := SkippedRegionEvent{1, int64(len(record2)), int64(len(garbage)), events[0].Reason}
+  if !reflect.DeepEqual(events[0], expected) || events[0].Reason == "" {
+    t.Errorf("reported %+v, expected %+v", events[0], expected)
+  }
+  if skippedRegions[0].FileNumber != 1 || skippedRegions[0].Offset != expected.Offset || skippedRegions[0].Length != expected.Length {
+    t.Errorf("called back with %v", skippedRegions[0])
+  }
+}
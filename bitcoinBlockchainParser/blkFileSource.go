@@ -0,0 +1,133 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "context"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/pkg/errors"
+)
+
+// BlkFileSource serves headers and blocks from bitcoind's blk files. Blocks
+// are fetched by hash, but read ahead along the chain returned by Headers
+// and decoded on options.DecodeWorkers goroutines, like Blocks does.
+type BlkFileSource struct {
+  parser     *BitcoinBlockchainParser
+  options    *BitcoinBlockchainParserOptions
+  blockInfos map[[32]byte]*BlockInfo
+
+  // read ahead state, next is the block the next result is for
+  results <-chan *BlockResult
+  cancel  context.CancelFunc
+  next    *BlockInfo
+}
+
+func NewBlkFileSource(directory string, chainCfg *chaincfg.Params, options *BitcoinBlockchainParserOptions) *BlkFileSource {
+  source := new(BlkFileSource)
+  source.parser = NewBitcoinBlockchainParser(directory, chainCfg, nil, nil)
+  source.options = options
+  return source
+}
+
+// Headers scans the blk files from the file position of start on and
+// returns the chains leading back to the parent of start, best first.
+// Without start the whole blk files are scanned.
+func (source *BlkFileSource) Headers(start *BlockInfo) ([]*Chain, error) {
+  source.stopReadAhead()
+
+  options := *source.options
+  if start != nil {
+    options.BlkFileNumber = start.BlkFileNumber
+    options.BlkFilePosition = start.BlkFilePosition
+    options.StopAtPrevHash = start.PrevHash
+    options.StartBlockHeight = start.Height
+  }
+
+  blockMap, blockOrder, err := source.parser.CollectBlockInfo(&options)
+  if err != nil {
+    return nil, err
+  }
+  if start != nil && blockMap[start.Hash] == nil {
+    return nil, nil
+  }
+
+  chains, err := source.parser.FindChains(blockMap, blockOrder, &options)
+  if err != nil {
+    return nil, err
+  }
+  source.blockInfos = blockMap
+  return chains, nil
+}
+
+// Block returns the block with the given hash. A block skipped by
+// options.OnDecodeError is returned as nil.
+func (source *BlkFileSource) Block(hash [32]byte) (*Block, error) {
+  blockInfo := source.blockInfos[hash]
+  if blockInfo == nil {
+    return nil, errors.Errorf("Block %x is not in the blk files", hash)
+  }
+
+  if source.results == nil || source.next != blockInfo {
+    source.stopReadAhead()
+    ctx, cancel := context.WithCancel(context.Background())
+    source.results = source.parser.blocksFrom(ctx, blockInfo, source.options)
+    source.cancel = cancel
+  }
+
+  result, ok := <-source.results
+  if !ok {
+    source.stopReadAhead()
+    return nil, errors.Errorf("Could not read block %x", hash)
+  }
+  if result.Err != nil {
+    source.stopReadAhead()
+    return nil, result.Err
+  }
+  source.next = blockInfo.NextBlockInfo
+  return result.Block, nil
+}
+
+// WatchTips calls onNewTip whenever bitcoind wrote to the blk files, checked
+// every options.FollowInterval until stop is closed
+func (source *BlkFileSource) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  return source.parser.WatchBlkFiles(source.options.FollowInterval, onNewTip, stop)
+}
+
+func (source *BlkFileSource) Close() error {
+  source.stopReadAhead()
+  return nil
+}
+
+func (source *BlkFileSource) stopReadAhead() {
+  if source.results == nil {
+    return
+  }
+  source.cancel()
+  for range source.results {
+  }
+  source.results = nil
+  source.cancel = nil
+  source.next = nil
+}
@@ -27,6 +27,8 @@ package bitcoinBlockchainParser
 import (
   "encoding/binary"
   "fmt"
+  "github.com/pkg/errors"
+  "math/big"
 )
 
 type BlockInfo struct {
@@ -39,6 +41,15 @@ type BlockInfo struct {
 
   BlkFilePosition int32
   BlkFileNumber   uint16
+  BlkUndoPosition int32
+
+  Version   uint32
+  Timestamp uint32
+  Bits      uint32
+
+  Height    uint64
+  Status    uint32
+  ChainWork *big.Int
 
   PartOfChain bool
 }
@@ -92,12 +103,13 @@ func (b *BlockInfo) ToBytes() []byte {
   // dont use varint for sake of simplicity. tradeof: a few more megabytes for an
   // index which has gigabytes in total
   // order: prevHash (32), nextHash (32), fileNumber (16), filePosition (32)
+  // filePosition only uses 4 bytes, bits and timestamp follow it so the
+  // retarget rules can be checked against a block loaded from an index
   infoBytes := make([]byte, 32+32+16+32)
   buffer := make([]byte, 32)
 
-  if b.PrevBlockInfo != nil {
-    copy(infoBytes[0:32], b.PrevBlockInfo.Hash[0:32])
-  }
+  // blocks received from bitcoind are not linked to their parent
+  copy(infoBytes[0:32], b.PrevHash[0:32])
 
   if b.NextBlockInfo != nil {
     copy(infoBytes[32:64], b.NextBlockInfo.Hash[0:32])
@@ -110,6 +122,9 @@ func (b *BlockInfo) ToBytes() []byte {
   buffer = buffer[0:32]
   binary.LittleEndian.PutUint32(buffer, uint32(b.BlkFilePosition))
   copy(infoBytes[80:112], buffer)
+
+  binary.LittleEndian.PutUint32(infoBytes[84:88], b.Bits)
+  binary.LittleEndian.PutUint32(infoBytes[88:92], b.Timestamp)
   return infoBytes
 }
 
@@ -132,6 +147,10 @@ func BlockInfoFromBytes(blockHash []byte, bytes []byte, blockInfoLookup map[[32]
   blockInfo.BlkFileNumber = blkFileNumber
   blockInfo.BlkFilePosition = int32(blkFilePosition)
 
+  // zero in entries written before bits and timestamp were stored
+  blockInfo.Bits = binary.LittleEndian.Uint32(bytes[84:88])
+  blockInfo.Timestamp = binary.LittleEndian.Uint32(bytes[88:92])
+
   if blockInfoLookup != nil {
 
     if bi, ok := blockInfoLookup[blockInfo.PrevHash]; ok {
@@ -149,6 +168,43 @@ func BlockInfoFromBytes(blockHash []byte, bytes []byte, blockInfoLookup map[[32]
   return blockInfo
 }
 
+// NewBlockInfoFromBlock creates the block info of a block which was not
+// found in a blk file but received from bitcoind directly. It has no file
+// position and no height.
+func NewBlockInfoFromBlock(block *Block) *BlockInfo {
+  blockInfo := new(BlockInfo)
+  blockInfo.Hash = block.Hash
+  blockInfo.Size = block.Size
+  blockInfo.PrevHash = block.PrevHash
+  blockInfo.Version = block.Version
+  blockInfo.Timestamp = block.Timestamp
+  blockInfo.Bits = binary.LittleEndian.Uint32(block.Difficulty[:])
+  return blockInfo
+}
+
+// NewBlockInfoFromHeader creates the block info of a serialized 80 byte
+// header, e.g. one returned by getblockheader. It has no file position, no
+// size and no height.
+func NewBlockInfoFromHeader(header []byte) (*BlockInfo, error) {
+  if len(header) != 80 {
+    return nil, errors.Errorf("Invalid header length %d", len(header))
+  }
+  blockInfo := new(BlockInfo)
+  copy(blockInfo.PrevHash[:], header[4:36])
+  ReverseBytes(blockInfo.PrevHash[:])
+  blockInfo.setHeader(header)
+  blockInfo.Hash = hashReversed(header)
+  return blockInfo, nil
+}
+
+// setHeader copies the fields needed for header checks from a serialized
+// 80 byte header
+func (b *BlockInfo) setHeader(header []byte) {
+  b.Version = binary.LittleEndian.Uint32(header[0:4])
+  b.Timestamp = binary.LittleEndian.Uint32(header[68:72])
+  b.Bits = binary.LittleEndian.Uint32(header[72:76])
+}
+
 func (b *BlockInfo) IsGenesis() bool {
   return !b.hasPrev()
 }
@@ -0,0 +1,230 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/pkg/errors"
+  "io"
+)
+
+// Consensus limits and minimal serialized sizes used to reject impossible
+// counts and lengths before allocating memory for them
+const maxBlockSerializedSize = 4000000
+const minTransactionSize = 60
+const minTxInputSize = 41
+const minTxOutputSize = 9
+
+// blockReader holds all state needed while reading one blk file, so
+// several parsers can run side by side without sharing buffers or positions
+type blockReader struct {
+  file     io.ReadSeeker
+  fileName string
+  position int
+  chainCfg *chaincfg.Params
+
+  buffer4  []byte
+  buffer80 []byte
+}
+
+func newBlockReader(file io.ReadSeeker, fileName string, chainCfg *chaincfg.Params) *blockReader {
+  r := new(blockReader)
+  r.file = file
+  r.fileName = fileName
+  r.chainCfg = chainCfg
+  r.buffer4 = make([]byte, 4)
+  r.buffer80 = make([]byte, 80)
+  return r
+}
+
+func (r *blockReader) seek(position int64) error {
+  _, err := r.file.Seek(position, 0)
+  if err != nil {
+    return err
+  }
+  r.position = int(position)
+  return nil
+}
+
+func (r *blockReader) magic() []byte {
+  magic := make([]byte, 4)
+  binary.LittleEndian.PutUint32(magic, uint32(r.chainCfg.Net))
+  return magic
+}
+
+// findNextMagic looks for the next occurrence of the network magic after
+// start. It returns its position or end if there is none, and whether all
+// skipped bytes were zero, which is the case for the preallocated tail of
+// a blk file.
+func (r *blockReader) findNextMagic(start int64, end int64) (int64, bool, error) {
+  magic := r.magic()
+  zeros := true
+  buffer := make([]byte, 64*1024)
+  position := start
+
+  for position < end {
+    err := r.seek(position)
+    if err != nil {
+      return end, zeros, err
+    }
+
+    length := int64(len(buffer))
+    if end-position < length {
+      length = end - position
+    }
+    n, err := io.ReadFull(r.file, buffer[:length])
+    if err != nil && err != io.ErrUnexpectedEOF {
+      return end, zeros, err
+    }
+    chunk := buffer[:n]
+
+    searchFrom := 0
+    if position == start {
+      searchFrom = 1
+    }
+    if searchFrom < len(chunk) {
+      index := bytes.Index(chunk[searchFrom:], magic)
+      if index >= 0 {
+        index += searchFrom
+        zeros = zeros && allZeroBytes(chunk[:index])
+        return position + int64(index), zeros, nil
+      }
+    }
+
+    if int64(n) < length || n <= len(magic) {
+      zeros = zeros && allZeroBytes(chunk)
+      break
+    }
+
+    // keep the last bytes, the magic could span two chunks
+    zeros = zeros && allZeroBytes(chunk[:n-len(magic)+1])
+    position += int64(n - len(magic) + 1)
+  }
+  return end, zeros, nil
+}
+
+func (r *blockReader) parseBlockInfo(fileSize int64) (*BlockInfo, error) {
+
+  blockInfo := new(BlockInfo)
+  var err error
+
+  // Magic
+  _, err = io.ReadFull(r.file, r.buffer4)
+  if err != nil {
+    return nil, errors.Wrap(err, "Read magic")
+  }
+  if !bytes.Equal(r.buffer4, r.magic()) {
+    return nil, &invalidRecordError{"Invalid magic", false}
+  }
+
+  // Size
+  _, err = io.ReadFull(r.file, r.buffer4)
+  if err != nil {
+    return nil, errors.Wrap(err, "Read size")
+  }
+  blockInfo.Size = binary.LittleEndian.Uint32(r.buffer4)
+  if blockInfo.Size == 0 {
+    return nil, &invalidRecordError{"Size is 0", true}
+  }
+  if blockInfo.Size < 80 || blockInfo.Size > maxBlockSerializedSize {
+    return nil, &invalidRecordError{fmt.Sprintf("Invalid size %d", blockInfo.Size), false}
+  }
+  if int64(r.position)+8+int64(blockInfo.Size) > fileSize {
+    return nil, &invalidRecordError{fmt.Sprintf("Size %d exceeds file", blockInfo.Size), true}
+  }
+
+  // Header
+  /* Read next 80 bytes which will contain
+    * version (4 bytes)
+        * hash of previous blockInfo (32 bytes)
+    * merkle root (32 bytes)
+        * time stamp (4 bytes)
+      * difficulty (4 bytes)
+    * nonce (4 bytes)
+  */
+  _, err = io.ReadFull(r.file, r.buffer80)
+  if err != nil {
+    return nil, errors.Wrap(err, "Read header")
+  }
+
+  copy(blockInfo.PrevHash[:], r.buffer80[4:36])
+  ReverseBytes(blockInfo.PrevHash[:])
+  blockInfo.setHeader(r.buffer80)
+
+  // Create blockInfo hash from those 80 bytes
+  blockInfo.Hash = hashReversed(r.buffer80)
+
+  return blockInfo, nil
+
+}
+
+// parseBlock reads the record at the current position: magic, size and the
+// block itself, which is decoded by a decoder limited to the record size
+func (r *blockReader) parseBlock() (*Block, int, error) {
+  // Magic
+  _, err := io.ReadFull(r.file, r.buffer4)
+  if err != nil {
+    return nil, 0, err
+  }
+  if !bytes.Equal(r.buffer4, r.magic()) {
+    return nil, 0, errors.Errorf("Invalid magic at offset %d", r.position)
+  }
+
+  // Size
+  _, err = io.ReadFull(r.file, r.buffer4)
+  if err != nil {
+    return nil, 0, err
+  }
+  size := binary.LittleEndian.Uint32(r.buffer4)
+  r.position += 8
+
+  if size > maxBlockSerializedSize {
+    return nil, 0, &DecodeError{r.fileName, int64(r.position - 4), "block size", fmt.Sprintf("%d exceeds maximum block size", size)}
+  }
+
+  d := newDecoder(io.LimitReader(r.file, int64(size)), r.fileName, r.position, r.position+int(size), r.chainCfg)
+  block, err := d.decodeBlock()
+  if err != nil {
+    return nil, 0, err
+  }
+
+  bytesUsed := 8 + int(block.Size)
+  r.position = d.position
+  block.Size = size
+
+  return block, bytesUsed, nil
+}
+
+func allZeroBytes(data []byte) bool {
+  for i := 0; i < len(data); i++ {
+    if data[i] != 0x00 {
+      return false
+    }
+  }
+  return true
+}
@@ -33,12 +33,30 @@ type Chain struct {
   Length int
 }
 
+// walkBack links the blocks of the chain through NextBlockInfo, from the
+// block following stopAtPrevHash up to Last. Branches share their blocks
+// before the fork point, so only the chain which is walked last is linked
+// there.
 func (c *Chain) walkBack(stopAtPrevHash [32]byte) {
   block := c.Last
+  c.Length = 1
   for !bytes.Equal(block.PrevHash[0:32], stopAtPrevHash[0:32]) {
     oldBlock := block
     block = block.PrevBlockInfo
     block.NextBlockInfo = oldBlock
+    c.Length++
+  }
+  c.First = block
+}
+
+// findFirst sets First and Length like walkBack without changing
+// NextBlockInfo
+func (c *Chain) findFirst(stopAtPrevHash [32]byte) {
+  block := c.Last
+  c.Length = 1
+  for !bytes.Equal(block.PrevHash[0:32], stopAtPrevHash[0:32]) {
+    block = block.PrevBlockInfo
+    c.Length++
   }
   c.First = block
 }
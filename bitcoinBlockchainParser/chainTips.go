@@ -0,0 +1,198 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "github.com/pkg/errors"
+  "io"
+  "path"
+  "sort"
+)
+
+// Chain tip states, named like the status field of Bitcoin Core's
+// getchaintips
+const (
+  ChainTipActive      = "active"
+  ChainTipValidFork   = "valid-fork"
+  ChainTipHeadersOnly = "headers-only"
+  ChainTipInvalid     = "invalid"
+)
+
+// ChainTip describes the tip of one branch found in the block data
+type ChainTip struct {
+  Tip *BlockInfo
+  // ForkPoint is the last block the branch shares with the active chain.
+  // It is nil for the active chain and for branches which only meet the
+  // active chain before options.StopAtPrevHash.
+  ForkPoint    *BlockInfo
+  BranchLength int
+  Status       string
+}
+
+// ChainTips reports every branch like getchaintips does, ordered by height.
+// The active chain is the valid chain with the most work which has data for
+// all of its blocks. Like FindChains it links the blocks in blockMap, so
+// call it on a fresh result of CollectBlockInfo.
+func (bc *BitcoinBlockchainParser) ChainTips(blockMap map[[32]byte]*BlockInfo, blockOrder []*BlockInfo, options *BitcoinBlockchainParserOptions) ([]*ChainTip, error) {
+  tips := make([]*ChainTip, 0)
+  if len(blockOrder) == 0 {
+    return tips, nil
+  }
+
+  chains, err := bc.findAllChains(blockMap, blockOrder, options)
+  if err != nil {
+    return nil, err
+  }
+
+  var active *Chain
+  for i := 0; i < len(chains); i++ {
+    if chains[i].Last.Status&BlockFailedMask != 0 || !hasAllData(chains[i].Last, nil, options) {
+      continue
+    }
+    if active == nil || chains[i].Last.ChainWork.Cmp(active.Last.ChainWork) > 0 {
+      active = chains[i]
+    }
+  }
+
+  onActive := make(map[*BlockInfo]bool)
+  if active != nil {
+    for blockInfo := active.Last; blockInfo != nil; blockInfo = prevInWindow(blockInfo, options) {
+      onActive[blockInfo] = true
+    }
+  }
+
+  for i := 0; i < len(chains); i++ {
+    tip := new(ChainTip)
+    tip.Tip = chains[i].Last
+
+    if chains[i] == active {
+      tip.Status = ChainTipActive
+      tips = append(tips, tip)
+      continue
+    }
+
+    blockInfo := chains[i].Last
+    for blockInfo != nil && !onActive[blockInfo] {
+      tip.BranchLength++
+      blockInfo = prevInWindow(blockInfo, options)
+    }
+    tip.ForkPoint = blockInfo
+
+    if tip.Tip.Status&BlockFailedMask != 0 {
+      tip.Status = ChainTipInvalid
+    } else if !hasAllData(tip.Tip, tip.ForkPoint, options) {
+      tip.Status = ChainTipHeadersOnly
+    } else {
+      tip.Status = ChainTipValidFork
+    }
+    tips = append(tips, tip)
+  }
+
+  sort.SliceStable(tips, func(i, j int) bool {
+    return tips[i].Tip.Height > tips[j].Tip.Height
+  })
+  return tips, nil
+}
+
+// ExportBranch writes the records of the blocks after tip.ForkPoint up to
+// tip.Tip to writer in blk file format. Written to blk00000.dat, the
+// branch can be read again by pointing a parser at its directory with
+// StopAtPrevHash set to the fork point.
+func (bc *BitcoinBlockchainParser) ExportBranch(tip *ChainTip, writer io.Writer) error {
+  err := bc.loadXorKey()
+  if err != nil {
+    return err
+  }
+
+  branch := make([]*BlockInfo, 0)
+  for blockInfo := tip.Tip; blockInfo != nil && blockInfo != tip.ForkPoint; blockInfo = blockInfo.PrevBlockInfo {
+    if blockInfo.Status&BlockHaveData == 0 {
+      return errors.Errorf("Block %x has no data on disk", blockInfo.Hash)
+    }
+    branch = append(branch, blockInfo)
+  }
+
+  var fileName string
+  var file blockFile
+  header := make([]byte, 8)
+  magic := make([]byte, 4)
+  binary.LittleEndian.PutUint32(magic, uint32(bc.chainCfg.Net))
+
+  defer func() {
+    if file != nil {
+      file.Close()
+    }
+  }()
+
+  for i := len(branch) - 1; i >= 0; i-- {
+    oldFileName := fileName
+    fileName = path.Join(bc.directory, fmt.Sprintf("blk%.5d.dat", branch[i].BlkFileNumber))
+
+    if oldFileName != fileName {
+      if file != nil {
+        file.Close()
+      }
+      file, err = bc.openBlockFile(fileName)
+      if err != nil {
+        file = nil
+        return err
+      }
+    }
+
+    raw, err := readRecord(file, int64(branch[i].BlkFilePosition), header, magic)
+    if err != nil {
+      return err
+    }
+    _, err = writer.Write(raw)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// prevInWindow returns the parent of blockInfo, or nil if blockInfo is the
+// first block after options.StopAtPrevHash
+func prevInWindow(blockInfo *BlockInfo, options *BitcoinBlockchainParserOptions) *BlockInfo {
+  if bytes.Equal(blockInfo.PrevHash[0:32], options.StopAtPrevHash[0:32]) {
+    return nil
+  }
+  return blockInfo.PrevBlockInfo
+}
+
+// hasAllData checks that all blocks from tip back to, but not including,
+// stop are stored in the blk files
+func hasAllData(tip *BlockInfo, stop *BlockInfo, options *BitcoinBlockchainParserOptions) bool {
+  for blockInfo := tip; blockInfo != nil && blockInfo != stop; blockInfo = prevInWindow(blockInfo, options) {
+    if blockInfo.Status&BlockHaveData == 0 {
+      return false
+    }
+  }
+  return true
+}
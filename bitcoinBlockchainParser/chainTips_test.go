@@ -0,0 +1,69 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "testing"
+)
+
+func TestChainTipsReportsOneBlockBranches(t *testing.T) {
+  directory := t.TempDir()
+  numbers := writeForkedTestChain(t, directory, []int{1, 2, 3, 4, 5, 6, 8, 7})
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tips, err := bc.ChainTips(blockMap, blockOrder, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  expected := []struct {
+    tip          int
+    height       uint64
+    forkPoint    int
+    branchLength int
+    status       string
+  }{
+    {7, 4, 0, 0, ChainTipActive},
+    {8, 3, 3, 1, ChainTipValidFork},
+    {6, 3, 2, 2, ChainTipValidFork},
+  }
+  if len(tips) != len(expected) {
+    t.Fatalf("found %d tips, expected %d", len(tips), len(expected))
+  }
+  for i, e := range expected {
+    forkPoint := 0
+    if tips[i].ForkPoint != nil {
+      forkPoint = numbers[tips[i].ForkPoint.Hash]
+    }
+    if numbers[tips[i].Tip.Hash] != e.tip || tips[i].Tip.Height != e.height || forkPoint != e.forkPoint || tips[i].BranchLength != e.branchLength || tips[i].Status != e.status {
+      t.Fatalf("tip %d is block %d at height %d forking after %d with length %d %s", i, numbers[tips[i].Tip.Hash], tips[i].Tip.Height, forkPoint, tips[i].BranchLength, tips[i].Status)
+    }
+  }
+}
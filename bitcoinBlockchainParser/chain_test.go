@@ -0,0 +1,133 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "reflect"
+  "testing"
+)
+
+// forkedTestChain lists the test blocks with their parents. Block 1 has no
+// parent, blocks 5 and 6 fork off after block 2 and block 8 is a one block
+// branch after block 3:
+//
+//   1 - 2 - 3 - 4 - 7
+//        \   \
+//         \   8
+//          5 - 6
+var forkedTestChain = []struct {
+  number int
+  parent int
+}{
+  {1, 0}, {2, 1}, {3, 2}, {4, 3}, {5, 2}, {6, 5}, {7, 4}, {8, 3},
+}
+
+// writeForkedTestChain writes forkedTestChain in the given order and returns
+// the block numbers by hash
+func writeForkedTestChain(t *testing.T, directory string, order []int) map[[32]byte]int {
+  blocks := make(map[int]*wire.MsgBlock)
+  numbers := make(map[[32]byte]int)
+  for _, b := range forkedTestChain {
+    prev := chainhash.Hash{}
+    if b.parent != 0 {
+      prev = blocks[b.parent].BlockHash()
+    }
+    blocks[b.number] = newTestBlock(t, prev, int64(1500000000+b.number*600), newTestCoinbase(uint32(b.number), 50, []byte{0x51}))
+    numbers[testHash(blocks[b.number])] = b.number
+  }
+
+  data := make([]byte, 0)
+  for _, number := range order {
+    data = append(data, testRecord(t, blocks[number])...)
+  }
+  writeTestFile(t, directory, "blk00000.dat", nil, data)
+  return numbers
+}
+
+func TestFindChainsLinksBestChain(t *testing.T) {
+  directory := t.TempDir()
+  numbers := writeForkedTestChain(t, directory, []int{1, 2, 3, 4, 5, 6, 7, 8})
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chains, err := bc.FindChains(blockMap, blockOrder, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 3 {
+    t.Fatalf("found %d chains, expected 3", len(chains))
+  }
+
+  walked := make([]int, 0)
+  for blockInfo := chains[0].First; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    walked = append(walked, numbers[blockInfo.Hash])
+  }
+  if !reflect.DeepEqual(walked, []int{1, 2, 3, 4, 7}) {
+    t.Fatalf("best chain walks %v", walked)
+  }
+  if chains[0].Length != 5 {
+    t.Fatalf("best chain has length %d", chains[0].Length)
+  }
+
+  // the other branches keep their first block without being linked
+  for i := 1; i < len(chains); i++ {
+    if numbers[chains[i].First.Hash] != 1 {
+      t.Fatalf("branch ending in %d starts at %d", numbers[chains[i].Last.Hash], numbers[chains[i].First.Hash])
+    }
+  }
+}
+
+func TestFindChainsOutOfOrder(t *testing.T) {
+  directory := t.TempDir()
+  numbers := writeForkedTestChain(t, directory, []int{1, 3, 4, 2})
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chains, err := bc.FindChains(blockMap, blockOrder, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 1 {
+    t.Fatalf("found %d chains, expected 1", len(chains))
+  }
+
+  walked := make([]int, 0)
+  for blockInfo := chains[0].First; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    walked = append(walked, numbers[blockInfo.Hash])
+  }
+  if !reflect.DeepEqual(walked, []int{1, 2, 3, 4}) {
+    t.Fatalf("chain walks %v", walked)
+  }
+}
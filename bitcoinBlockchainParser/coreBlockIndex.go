@@ -0,0 +1,259 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/pkg/errors"
+  "github.com/syndtr/goleveldb/leveldb"
+  "github.com/syndtr/goleveldb/leveldb/opt"
+  "github.com/syndtr/goleveldb/leveldb/util"
+  "path"
+  "sort"
+  "time"
+)
+
+// Block status flags as stored by Bitcoin Core in blocks/index
+const (
+  BlockValidHeader       = 1
+  BlockValidTree         = 2
+  BlockValidTransactions = 3
+  BlockValidChain        = 4
+  BlockValidScripts      = 5
+  BlockValidMask         = 7
+  BlockHaveData          = 8
+  BlockHaveUndo          = 16
+  BlockFailedValid       = 32
+  BlockFailedChild       = 64
+  BlockFailedMask        = BlockFailedValid | BlockFailedChild
+)
+
+// collectCoreBlockInfo reads every block index entry from Bitcoin Core's
+// leveldb in <directory>/index instead of scanning the blk files. The
+// database is opened read only, so point the parser to a copy of the blocks
+// directory if bitcoind is running.
+func (bc *BitcoinBlockchainParser) collectCoreBlockInfo(options *BitcoinBlockchainParserOptions) (map[[32]byte]*BlockInfo, []*BlockInfo, error) {
+  indexDirectory := path.Join(bc.directory, "index")
+
+  start := time.Now()
+  options.report(FileOpenedEvent{File: indexDirectory})
+
+  db, err := leveldb.OpenFile(indexDirectory, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+  if err != nil {
+    return nil, nil, err
+  }
+  defer db.Close()
+
+  blockOrder := make([]*BlockInfo, 0)
+  blockMap := make(map[[32]byte]*BlockInfo)
+
+  iter := db.NewIterator(util.BytesPrefix([]byte{'b'}), nil)
+  for iter.Next() {
+    blockInfo, err := blockInfoFromCoreIndex(iter.Value())
+    if err != nil {
+      iter.Release()
+      return nil, nil, errors.Wrapf(err, "Block index entry %x", iter.Key()[1:])
+    }
+    blockOrder = append(blockOrder, blockInfo)
+    blockMap[blockInfo.Hash] = blockInfo
+  }
+  iter.Release()
+
+  err = iter.Error()
+  if err != nil {
+    return nil, nil, err
+  }
+
+  sort.SliceStable(blockOrder, func(i, j int) bool {
+    return blockOrder[i].Height < blockOrder[j].Height
+  })
+
+  options.report(newBlocksScannedEvent(StageScan, len(blockOrder), 0, 0, start, true))
+  return blockMap, blockOrder, nil
+}
+
+// findCoreBestChain picks the fully validated block with the most chain
+// work from Core's block index as tip and links it back to
+// options.StopAtPrevHash. On equal work the block stored first wins, like
+// the block received first does in Core. There is no chain if the best
+// chain does not lead back to options.StopAtPrevHash.
+func (bc *BitcoinBlockchainParser) findCoreBestChain(blockMap map[[32]byte]*BlockInfo, blockOrder []*BlockInfo, options *BitcoinBlockchainParserOptions) ([]*Chain, error) {
+  chains := make([]*Chain, 0)
+
+  // blockOrder is sorted by height, parents come first
+  for i := 0; i < len(blockOrder); i++ {
+    work := blockchain.CalcWork(blockOrder[i].Bits)
+    if parent := blockMap[blockOrder[i].PrevHash]; parent != nil && parent.ChainWork != nil {
+      work.Add(work, parent.ChainWork)
+    }
+    blockOrder[i].ChainWork = work
+  }
+
+  tipIndex := -1
+  for i := 0; i < len(blockOrder); i++ {
+    status := blockOrder[i].Status
+    if status&BlockFailedMask != 0 || status&BlockValidMask < BlockValidScripts || status&BlockHaveData == 0 {
+      continue
+    }
+    if tipIndex == -1 {
+      tipIndex = i
+      continue
+    }
+    tip := blockOrder[tipIndex]
+    cmp := blockOrder[i].ChainWork.Cmp(tip.ChainWork)
+    if cmp > 0 || cmp == 0 && (blockOrder[i].BlkFileNumber < tip.BlkFileNumber || blockOrder[i].BlkFileNumber == tip.BlkFileNumber && blockOrder[i].BlkFilePosition < tip.BlkFilePosition) {
+      tipIndex = i
+    }
+  }
+
+  if tipIndex == -1 {
+    return chains, errors.New("No validated block in block index")
+  }
+
+  count := 1
+  blockInfo := blockOrder[tipIndex]
+  for !bytes.Equal(blockInfo.PrevHash[0:32], options.StopAtPrevHash[0:32]) {
+    prevBlockInfo := blockMap[blockInfo.PrevHash]
+    if prevBlockInfo == nil {
+      // the requested block is not on the best chain
+      return chains, nil
+    }
+    if prevBlockInfo.Status&BlockHaveData == 0 {
+      return chains, errors.Errorf("Block %x has no data on disk", prevBlockInfo.Hash)
+    }
+    blockInfo.PrevBlockInfo = prevBlockInfo
+    blockInfo.PartOfChain = true
+    blockInfo = prevBlockInfo
+    count++
+  }
+  blockInfo.PartOfChain = true
+
+  chain := new(Chain)
+  chain.Index = tipIndex
+  chain.Last = blockOrder[tipIndex]
+  chain.Length = count
+  chain.walkBack(options.StopAtPrevHash)
+
+  chains = append(chains, chain)
+  return chains, nil
+}
+
+// blockInfoFromCoreIndex decodes a serialized CDiskBlockIndex
+func blockInfoFromCoreIndex(value []byte) (*BlockInfo, error) {
+  var err error
+  var status, file, dataPosition, undoPosition uint64
+  offset := 0
+
+  // client version
+  _, offset, err = readCoreVarInt(value, offset)
+  if err != nil {
+    return nil, err
+  }
+
+  blockInfo := new(BlockInfo)
+  blockInfo.Height, offset, err = readCoreVarInt(value, offset)
+  if err != nil {
+    return nil, err
+  }
+
+  status, offset, err = readCoreVarInt(value, offset)
+  if err != nil {
+    return nil, err
+  }
+  blockInfo.Status = uint32(status)
+
+  // tx count
+  _, offset, err = readCoreVarInt(value, offset)
+  if err != nil {
+    return nil, err
+  }
+
+  if status&(BlockHaveData|BlockHaveUndo) != 0 {
+    file, offset, err = readCoreVarInt(value, offset)
+    if err != nil {
+      return nil, err
+    }
+    blockInfo.BlkFileNumber = uint16(file)
+  }
+
+  // core stores the position of the block data itself, the
+  // record starts with 4 bytes magic and 4 bytes size before that
+  if status&BlockHaveData != 0 {
+    dataPosition, offset, err = readCoreVarInt(value, offset)
+    if err != nil {
+      return nil, err
+    }
+    blockInfo.BlkFilePosition = int32(dataPosition) - 8
+  }
+
+  if status&BlockHaveUndo != 0 {
+    undoPosition, offset, err = readCoreVarInt(value, offset)
+    if err != nil {
+      return nil, err
+    }
+    blockInfo.BlkUndoPosition = int32(undoPosition) - 8
+  }
+
+  if len(value)-offset < 80 {
+    return nil, errors.New("Block header too short")
+  }
+  header := value[offset : offset+80]
+
+  copy(blockInfo.PrevHash[:], header[4:36])
+  ReverseBytes(blockInfo.PrevHash[:])
+  blockInfo.setHeader(header)
+
+  pass := sha256.Sum256(header)
+  pass = sha256.Sum256(pass[:])
+  ReverseBytes(pass[:])
+  copy(blockInfo.Hash[:], pass[:])
+
+  return blockInfo, nil
+}
+
+// readCoreVarInt reads Bitcoin Core's VARINT encoding, which is not the
+// CompactSize used in blocks and transactions
+func readCoreVarInt(data []byte, offset int) (uint64, int, error) {
+  n := uint64(0)
+  for {
+    if offset >= len(data) {
+      return 0, offset, errors.New("Unexpected end of varint")
+    }
+    if n > (^uint64(0))>>7 {
+      return 0, offset, errors.New("Varint too large")
+    }
+    b := data[offset]
+    offset++
+    n = (n << 7) | uint64(b&0x7f)
+    if b&0x80 == 0 {
+      return n, offset, nil
+    }
+    n++
+  }
+}
+
@@ -0,0 +1,163 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "github.com/syndtr/goleveldb/leveldb"
+  "path"
+  "reflect"
+  "testing"
+)
+
+// coreVarInt encodes n like Bitcoin Core's VARINT, see readCoreVarInt
+func coreVarInt(n uint64) []byte {
+  encoded := make([]byte, 0)
+  for {
+    b := byte(n & 0x7f)
+    if len(encoded) > 0 {
+      b |= 0x80
+    }
+    encoded = append([]byte{b}, encoded...)
+    if n <= 0x7f {
+      return encoded
+    }
+    n = (n >> 7) - 1
+  }
+}
+
+// coreIndexEntry serializes a CDiskBlockIndex of a block stored at
+// position in blk00000.dat
+func coreIndexEntry(t *testing.T, block *wire.MsgBlock, height uint64, status uint64, position int) []byte {
+  var entry bytes.Buffer
+  entry.Write(coreVarInt(250000))
+  entry.Write(coreVarInt(height))
+  entry.Write(coreVarInt(status))
+  entry.Write(coreVarInt(uint64(len(block.Transactions))))
+  entry.Write(coreVarInt(0))
+  // Core points behind magic and size
+  entry.Write(coreVarInt(uint64(position + 8)))
+  err := block.Header.Serialize(&entry)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return entry.Bytes()
+}
+
+func TestCoreBlockIndexPicksMostWork(t *testing.T) {
+  // blocks 1 and 2 are shared, a longer branch of minimum difficulty blocks
+  // follows and a shorter one with a block of more work
+  type testBlock struct {
+    name   string
+    parent string
+    bits   uint32
+    status uint64
+  }
+  valid := uint64(BlockValidScripts | BlockHaveData)
+  testBlocks := []testBlock{
+    {"1", "", testChainCfg.PowLimitBits, valid},
+    {"2", "1", testChainCfg.PowLimitBits, valid},
+    {"a3", "2", testChainCfg.PowLimitBits, valid},
+    {"a4", "a3", testChainCfg.PowLimitBits, valid},
+    {"a5", "a4", testChainCfg.PowLimitBits, valid},
+    {"b3", "2", 0x1f7fffff, valid},
+    // more work, but failed validation
+    {"c3", "2", 0x1f0fffff, valid | BlockFailedValid},
+  }
+
+  directory := t.TempDir()
+  db, err := leveldb.OpenFile(path.Join(directory, "index"), nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  blocks := make(map[string]*wire.MsgBlock)
+  heights := make(map[string]uint64)
+  names := make(map[[32]byte]string)
+  data := make([]byte, 0)
+  for i, b := range testBlocks {
+    prev := chainhash.Hash{}
+    if b.parent != "" {
+      prev = blocks[b.parent].BlockHash()
+      heights[b.name] = heights[b.parent] + 1
+    }
+    block := newTestBlockWithBits(t, prev, int64(1500000000+i*600), b.bits, newTestCoinbase(uint32(i), 50, []byte{0x51}))
+    blocks[b.name] = block
+    names[testHash(block)] = b.name
+
+    hash := block.BlockHash()
+    err = db.Put(append([]byte{'b'}, hash[:]...), coreIndexEntry(t, block, heights[b.name], b.status, len(data)), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+    data = append(data, testRecord(t, block)...)
+  }
+  err = db.Close()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // the blocks are read through the index from obfuscated blk files
+  xorKey := []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+  writeTestFile(t, directory, "xor.dat", nil, xorKey)
+  writeTestFile(t, directory, "blk00000.dat", xorKey, data)
+
+  options := newTestParserOptions()
+  options.UseCoreBlockIndex = true
+  source := NewBlkFileSource(directory, testChainCfg, options)
+  defer source.Close()
+
+  chains, err := source.Headers(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 1 || names[chains[0].Last.Hash] != "b3" {
+    t.Fatalf("found %d chains, the best ending in %s", len(chains), names[chains[0].Last.Hash])
+  }
+
+  read := make([]string, 0)
+  for blockInfo := chains[0].First; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    block, err := source.Block(blockInfo.Hash)
+    if err != nil {
+      t.Fatal(err)
+    }
+    read = append(read, names[block.Hash])
+  }
+  if !reflect.DeepEqual(read, []string{"1", "2", "b3"}) {
+    t.Fatalf("read %v", read)
+  }
+
+  // a block which is not on the best chain has no chain following it
+  start := &BlockInfo{Hash: testHash(blocks["a4"]), PrevHash: testHash(blocks["a3"]), Height: 4}
+  chains, err = source.Headers(start)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 0 {
+    t.Fatalf("found %d chains after a3", len(chains))
+  }
+}
@@ -0,0 +1,416 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/binary"
+  "fmt"
+  "github.com/btcsuite/btcd/chaincfg"
+  "io"
+  "math"
+)
+
+// decoder decodes blocks and transactions from any io.Reader. position is
+// the offset of the next byte in the underlying file or buffer and is used
+// for witness item positions and decode errors, end is the offset after
+// which no more data of the current block may follow.
+type decoder struct {
+  reader   io.Reader
+  fileName string
+  position int
+  end      int
+  chainCfg *chaincfg.Params
+
+  buffer  []byte
+  raw     []byte
+  capture bool
+}
+
+func newDecoder(reader io.Reader, fileName string, position int, end int, chainCfg *chaincfg.Params) *decoder {
+  d := new(decoder)
+  d.reader = reader
+  d.fileName = fileName
+  d.position = position
+  d.end = end
+  d.chainCfg = chainCfg
+  d.buffer = make([]byte, 80)
+  d.raw = make([]byte, 0, 1024)
+  return d
+}
+
+// DecodeBlock decodes a serialized block, as stored in blk files after magic
+// and size, returned by getblock <hash> 0 or published as zmq rawblock
+func DecodeBlock(reader io.Reader, chainCfg *chaincfg.Params) (*Block, error) {
+  d := newDecoder(reader, "", 0, maxBlockSerializedSize, chainCfg)
+  return d.decodeBlock()
+}
+
+// DecodeTransaction decodes a single serialized transaction
+func DecodeTransaction(data []byte, chainCfg *chaincfg.Params) (*Transaction, error) {
+  d := newDecoder(bytes.NewReader(data), "", 0, len(data), chainCfg)
+  tx := new(Transaction)
+  err := d.decodeTransaction(tx)
+  if err != nil {
+    return nil, err
+  }
+  if d.position != len(data) {
+    return nil, d.decodeError("transaction", fmt.Sprintf("%d bytes of trailing data", len(data)-d.position))
+  }
+  return tx, nil
+}
+
+func (d *decoder) decodeBlock() (*Block, error) {
+  start := d.position
+  block := new(Block)
+
+  // Header
+  /* Read next 80 bytes which will contain
+    * version (4 bytes)
+        * hash of previous block (32 bytes)
+    * merkle root (32 bytes)
+        * time stamp (4 bytes)
+      * difficulty (4 bytes)
+    * nonce (4 bytes)
+  */
+  header := d.buffer[0:80]
+  err := d.read(header, "header")
+  if err != nil {
+    return nil, err
+  }
+
+  block.Version = binary.LittleEndian.Uint32(header[0:4])
+  copy(block.PrevHash[:], header[4:36])
+  ReverseBytes(block.PrevHash[:])
+
+  copy(block.MerkleRoot[:], header[36:68])
+  block.Timestamp = binary.LittleEndian.Uint32(header[68:72])
+  copy(block.Difficulty[:], header[72:76])
+  block.Nonce = binary.LittleEndian.Uint32(header[76:80])
+
+  block.Hash = hashReversed(header)
+
+  txCount, err := d.readCount("tx count")
+  if err != nil {
+    return nil, err
+  }
+
+  err = d.checkCount("tx count", txCount, minTransactionSize)
+  if err != nil {
+    return nil, err
+  }
+
+  if txCount > 0 {
+    block.Transactions = make([]Transaction, txCount)
+    for t := 0; t < int(txCount); t++ {
+      err = d.decodeTransaction(&block.Transactions[t])
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  block.Size = uint32(d.position - start)
+  return block, nil
+}
+
+// decodeTransaction captures the raw bytes of the transaction while reading
+// it. The wtxid is the hash of all of them, the txid leaves out marker, flag
+// and witness data.
+func (d *decoder) decodeTransaction(tx *Transaction) error {
+  d.raw = d.raw[:0]
+  d.capture = true
+  defer func() {
+    d.capture = false
+  }()
+
+  var err error
+
+  // Version
+  tx.Version, err = d.readUint32("version")
+  if err != nil {
+    return err
+  }
+
+  inputCount, err := d.readCount("input count")
+  if err != nil {
+    return err
+  }
+
+  // is witness flag present?
+  // 0 says yes, cause there are no tx with 0 inputs
+  if inputCount == 0 {
+    flag := d.buffer[0:1]
+    err = d.read(flag, "witness flag")
+    if err != nil {
+      return err
+    }
+    if flag[0] != 0x01 {
+      return d.decodeError("witness flag", fmt.Sprintf("unknown flag %d", flag[0]))
+    }
+    tx.Witness = true
+
+    inputCount, err = d.readCount("input count")
+    if err != nil {
+      return err
+    }
+  }
+
+  err = d.checkCount("input count", inputCount, minTxInputSize)
+  if err != nil {
+    return err
+  }
+
+  tx.Inputs = make([]TxInput, inputCount)
+
+  for i := 0; i < int(inputCount); i++ {
+    // Source tx hash
+    err = d.read(tx.Inputs[i].SourceTxHash[:], "input hash")
+    if err != nil {
+      return err
+    }
+
+    // Source tx output index
+    tx.Inputs[i].OutputIndex, err = d.readUint32("input index")
+    if err != nil {
+      return err
+    }
+
+    // Script
+    scriptLength, err := d.readCount("input script length")
+    if err != nil {
+      return err
+    }
+    if scriptLength > 0 {
+      tx.Inputs[i].Script, err = d.readBytes(scriptLength, "input script")
+      if err != nil {
+        return err
+      }
+    }
+
+    // Sequence
+    tx.Inputs[i].Sequence, err = d.readUint32("sequence")
+    if err != nil {
+      return err
+    }
+  }
+
+  // Output count
+  outputCount, err := d.readCount("output count")
+  if err != nil {
+    return err
+  }
+
+  err = d.checkCount("output count", outputCount, minTxOutputSize)
+  if err != nil {
+    return err
+  }
+
+  tx.Outputs = make([]TxOutput, outputCount)
+
+  for o := 0; o < int(outputCount); o++ {
+    // Value
+    tx.Outputs[o].Value, err = d.readUint64("value")
+    if err != nil {
+      return err
+    }
+    tx.Amount += tx.Outputs[o].Value
+
+    // Script
+    scriptLength, err := d.readCount("output script length")
+    if err != nil {
+      return err
+    }
+    if scriptLength > 0 {
+      script, err := d.readBytes(scriptLength, "output script")
+      if err != nil {
+        return err
+      }
+      tx.Outputs[o].Script = NewScript(script, d.chainCfg)
+    }
+  }
+
+  witnessStart := len(d.raw)
+
+  if tx.Witness {
+    for i := 0; i < int(inputCount); i++ {
+      witnessLength, err := d.readCount("witness item count")
+      if err != nil {
+        return err
+      }
+
+      err = d.checkCount("witness item count", witnessLength, 1)
+      if err != nil {
+        return err
+      }
+
+      // Witness
+      witness := make([]WitnessItem, witnessLength)
+      for w := 0; w < int(witnessLength); w++ {
+        witnessItemLength, err := d.readCount("witness item length")
+        if err != nil {
+          return err
+        }
+
+        witness[w].BlkFilePosition = d.position
+        witness[w].Data, err = d.readBytes(witnessItemLength, "witness item")
+        if err != nil {
+          return err
+        }
+      }
+      tx.Inputs[i].Witness = witness
+    }
+  }
+
+  witnessEnd := len(d.raw)
+
+  // Lock time
+  tx.Locktime, err = d.readUint32("lock time")
+  if err != nil {
+    return err
+  }
+
+  tx.Size = len(d.raw)
+  tx.WtxId = hashReversed(d.raw)
+
+  if tx.Witness {
+    tx.BaseSize = tx.Size - 2 - (witnessEnd - witnessStart)
+
+    txidData := make([]byte, 0, tx.BaseSize)
+    txidData = append(txidData, d.raw[0:4]...)
+    txidData = append(txidData, d.raw[6:witnessStart]...)
+    txidData = append(txidData, d.raw[witnessEnd:]...)
+    tx.TxId = hashReversed(txidData)
+  } else {
+    tx.BaseSize = tx.Size
+    tx.TxId = tx.WtxId
+  }
+
+  tx.Weight = tx.BaseSize*3 + tx.Size
+  tx.VirtualSize = int(math.Ceil(float64(tx.Weight) / 4))
+
+  return nil
+}
+
+func (d *decoder) read(data []byte, field string) error {
+  n, err := io.ReadFull(d.reader, data)
+  d.position += n
+  if d.capture {
+    d.raw = append(d.raw, data[:n]...)
+  }
+  if err == io.EOF || err == io.ErrUnexpectedEOF {
+    return d.decodeError(field, "unexpected end of data")
+  }
+  return err
+}
+
+func (d *decoder) readUint32(field string) (uint32, error) {
+  data := d.buffer[0:4]
+  err := d.read(data, field)
+  if err != nil {
+    return 0, err
+  }
+  return binary.LittleEndian.Uint32(data), nil
+}
+
+func (d *decoder) readUint64(field string) (uint64, error) {
+  data := d.buffer[0:8]
+  err := d.read(data, field)
+  if err != nil {
+    return 0, err
+  }
+  return binary.LittleEndian.Uint64(data), nil
+}
+
+func (d *decoder) readBytes(length uint64, field string) ([]byte, error) {
+  err := d.checkCount(field, length, 1)
+  if err != nil {
+    return nil, err
+  }
+  data := make([]byte, length)
+  err = d.read(data, field)
+  if err != nil {
+    return nil, err
+  }
+  return data, nil
+}
+
+// readCount reads a CompactSize
+func (d *decoder) readCount(field string) (uint64, error) {
+  b := d.buffer[0:1]
+  err := d.read(b, field)
+  if err != nil {
+    return 0, err
+  }
+
+  byteCount := 0
+  if b[0] < 253 {
+    return uint64(b[0]), nil
+  } else if b[0] == 253 {
+    byteCount = 2
+  } else if b[0] == 254 {
+    byteCount = 4
+  } else {
+    byteCount = 8
+  }
+
+  data := d.buffer[0:byteCount]
+  err = d.read(data, field)
+  if err != nil {
+    return 0, err
+  }
+  for i := byteCount; i < 8; i++ {
+    d.buffer[i] = 0
+  }
+  return binary.LittleEndian.Uint64(d.buffer[0:8]), nil
+}
+
+// checkCount makes sure count items of at least minSize bytes each can
+// still fit into the rest of the block
+func (d *decoder) checkCount(field string, count uint64, minSize uint64) error {
+  remaining := d.end - d.position
+  if remaining < 0 {
+    remaining = 0
+  }
+  if count > maxBlockSerializedSize || count*minSize > uint64(remaining) {
+    return d.decodeError(field, fmt.Sprintf("%d exceeds the %d bytes left in block", count, remaining))
+  }
+  return nil
+}
+
+func (d *decoder) decodeError(field string, reason string) *DecodeError {
+  return &DecodeError{d.fileName, int64(d.position), field, reason}
+}
+
+// hashReversed returns the double sha256 of data in the byte order used for
+// display and throughout this package
+func hashReversed(data []byte) [32]byte {
+  pass := sha256.Sum256(data)
+  pass = sha256.Sum256(pass[:])
+  ReverseBytes(pass[:])
+  return pass
+}
@@ -0,0 +1,189 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "github.com/btcsuite/btcutil"
+  "testing"
+)
+
+// malformedTestRecord returns a blk record with the header of block and a
+// single transaction serialized as tx
+func malformedTestRecord(t *testing.T, headerOf []byte, tx []byte) []byte {
+  record := make([]byte, 0, 8+80+1+len(tx))
+  record = append(record, headerOf[0:8+80]...)
+  record = append(record, 1)
+  record = append(record, tx...)
+  binary.LittleEndian.PutUint32(record[4:8], uint32(len(record)-8))
+  return record
+}
+
+func TestDecodeErrorsQuarantineBlock(t *testing.T) {
+  le32 := func(n uint32) []byte {
+    data := make([]byte, 4)
+    binary.LittleEndian.PutUint32(data, n)
+    return data
+  }
+  join := func(parts ...[]byte) []byte {
+    return bytes.Join(parts, nil)
+  }
+  version := le32(1)
+  input := join(bytes.Repeat([]byte{0x11}, 32), le32(0), []byte{0}, le32(0xffffffff))
+  output := join(make([]byte, 8), []byte{5}, bytes.Repeat([]byte{0x51}, 5))
+  // the tx count check wants room for a minimal transaction
+  padding := make([]byte, minTransactionSize)
+
+  // offsets are relative to the first transaction
+  tests := []struct {
+    name   string
+    tx     []byte
+    offset int64
+    field  string
+  }{
+    {"huge input count", join(version, []byte{0xfe}, le32(0xffffffff), padding), 9, "input count"},
+    {"huge script length", join(version, []byte{1}, input[0:36], []byte{0xfe}, le32(0xffffffff), padding), 46, "input script"},
+    {"witness count beyond remaining bytes", join(version, []byte{0, 1, 1}, input, []byte{1}, output, []byte{200}, le32(0)), 64, "witness item count"},
+    {"truncated tx", join(version, []byte{1}, input, []byte{1}, output, []byte{0, 0}), 63, "lock time"},
+  }
+
+  for _, test := range tests {
+    for _, workers := range []int{1, 4} {
+      directory := t.TempDir()
+      block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, []byte{0x51}))
+      block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 50, []byte{0x51}))
+      block3 := newTestBlock(t, block2.BlockHash(), 1500001200, newTestCoinbase(3, 50, []byte{0x51}))
+      record1 := testRecord(t, block1)
+      record2 := malformedTestRecord(t, testRecord(t, block2), test.tx)
+      writeTestFile(t, directory, "blk00000.dat", nil, join(record1, record2, testRecord(t, block3)))
+
+      parsed := make([][32]byte, 0)
+      bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, func(number int, count int, block *Block) error {
+        parsed = append(parsed, block.Hash)
+        return nil
+      })
+      options := newTestParserOptions()
+      options.DecodeWorkers = workers
+      decodeErrors := make([]*DecodeError, 0)
+      options.OnDecodeError = func(blockInfo *BlockInfo, decodeError *DecodeError) error {
+        if blockInfo.Hash != testHash(block2) {
+          t.Errorf("%s: block %x quarantined", test.name, blockInfo.Hash)
+        }
+        decodeErrors = append(decodeErrors, decodeError)
+        return nil
+      }
+
+      blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+      if err != nil {
+        t.Fatal(err)
+      }
+      chains, err := bc.FindChains(blockMap, blockOrder, options)
+      if err != nil {
+        t.Fatal(err)
+      }
+      err = bc.ParseBlocks(chains[0], options)
+      if err != nil {
+        t.Fatalf("%s, %d workers: %v", test.name, workers, err)
+      }
+
+      if len(parsed) != 2 || parsed[0] != testHash(block1) || parsed[1] != testHash(block3) {
+        t.Errorf("%s, %d workers: parsed %x", test.name, workers, parsed)
+      }
+      if len(decodeErrors) != 1 {
+        t.Fatalf("%s, %d workers: %d decode errors", test.name, workers, len(decodeErrors))
+      }
+      decodeError := decodeErrors[0]
+      offset := int64(len(record1)) + 8 + 80 + 1 + test.offset
+      if decodeError.File != "blk00000.dat" || decodeError.Offset != offset || decodeError.Field != test.field {
+        t.Errorf("%s, %d workers: %v, expected blk00000.dat at %d in %s", test.name, workers, decodeError, offset, test.field)
+      }
+
+      // without OnDecodeError the error ends parsing
+      options.OnDecodeError = nil
+      err = bc.ParseBlocks(chains[0], options)
+      if _, ok := err.(*DecodeError); !ok {
+        t.Errorf("%s, %d workers: %v", test.name, workers, err)
+      }
+    }
+  }
+}
+
+func TestDecodeTransactionMatchesWire(t *testing.T) {
+  // a segwit transaction with an input without witness in between
+  mixed := newTestSpend(3, wire.TxWitness{{0x30, 0x44, 0x02}, {0x03, 0x21}})
+  prevHash := chainhash.Hash{4}
+  mixed.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 7), []byte{0x51}, nil))
+  prevHash = chainhash.Hash{5}
+  mixed.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 1), nil, wire.TxWitness{{}, bytes.Repeat([]byte{0x52}, 300)}))
+  mixed.AddTxOut(wire.NewTxOut(5000, []byte{0x6a}))
+  mixed.LockTime = 500000
+
+  tests := []struct {
+    name string
+    tx   *wire.MsgTx
+  }{
+    {"coinbase", newTestCoinbase(1, 50, []byte{0x51})},
+    {"legacy", newTestSpend(1, nil)},
+    {"segwit", newTestSpend(2, wire.TxWitness{{0x30, 0x01}, {0x02, 0x03}})},
+    {"mixed segwit", mixed},
+  }
+  for _, test := range tests {
+    var buffer bytes.Buffer
+    err := test.tx.Serialize(&buffer)
+    if err != nil {
+      t.Fatal(err)
+    }
+    tx, err := DecodeTransaction(buffer.Bytes(), testChainCfg)
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+
+    txHash := test.tx.TxHash()
+    witnessHash := test.tx.WitnessHash()
+    weight := int(blockchain.GetTransactionWeight(btcutil.NewTx(test.tx)))
+    if tx.TxIdString() != txHash.String() {
+      t.Errorf("%s: txid %s, expected %s", test.name, tx.TxIdString(), txHash)
+    }
+    if tx.WtxIdString() != witnessHash.String() {
+      t.Errorf("%s: wtxid %s, expected %s", test.name, tx.WtxIdString(), witnessHash)
+    }
+    if tx.Witness != test.tx.HasWitness() {
+      t.Errorf("%s: witness %v, expected %v", test.name, tx.Witness, test.tx.HasWitness())
+    }
+    if tx.Size != test.tx.SerializeSize() || tx.BaseSize != test.tx.SerializeSizeStripped() {
+      t.Errorf("%s: size %d/%d, expected %d/%d", test.name, tx.Size, tx.BaseSize, test.tx.SerializeSize(), test.tx.SerializeSizeStripped())
+    }
+    if tx.Weight != weight || tx.VirtualSize != (weight+3)/4 {
+      t.Errorf("%s: weight %d vsize %d, expected %d %d", test.name, tx.Weight, tx.VirtualSize, weight, (weight+3)/4)
+    }
+    if tx.Version != uint32(test.tx.Version) || tx.Locktime != test.tx.LockTime || len(tx.Inputs) != len(test.tx.TxIn) || len(tx.Outputs) != len(test.tx.TxOut) {
+      t.Errorf("%s: decoded %d inputs and %d outputs, version %d, lock time %d", test.name, len(tx.Inputs), len(tx.Outputs), tx.Version, tx.Locktime)
+    }
+  }
+}
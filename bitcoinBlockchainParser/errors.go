@@ -0,0 +1,67 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import "fmt"
+
+// SkippedRegionError describes a region of a blk file which did not contain
+// a valid block record and was skipped while scanning for the next one
+type SkippedRegionError struct {
+  FileNumber uint16
+  Offset     int64
+  Length     int64
+  Reason     string
+}
+
+func (e *SkippedRegionError) Error() string {
+  return fmt.Sprintf("Skipped %d bytes at offset %d in blk%.5d.dat: %s", e.Length, e.Offset, e.FileNumber, e.Reason)
+}
+
+// invalidRecordError is returned by the reader when the data at the current
+// position does not look like a block record. An incomplete record may
+// still be written by bitcoind.
+type invalidRecordError struct {
+  reason     string
+  incomplete bool
+}
+
+func (e *invalidRecordError) Error() string {
+  return e.reason
+}
+
+// DecodeError is returned when a block contains counts or lengths which
+// cannot be valid, so the block can be skipped instead of allocating
+// whatever a corrupted file asks for
+type DecodeError struct {
+  File   string
+  Offset int64
+  Field  string
+  Reason string
+}
+
+func (e *DecodeError) Error() string {
+  return fmt.Sprintf("Decode error in %s at offset %d, %s: %s", e.File, e.Offset, e.Field, e.Reason)
+}
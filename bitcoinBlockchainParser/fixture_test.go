@@ -0,0 +1,114 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "io/ioutil"
+  "omnom/testFixture"
+  "path"
+  "testing"
+)
+
+// test fixtures are regtest blocks, their targets are met after a few
+// nonces
+var testChainCfg = &chaincfg.RegressionNetParams
+
+// newTestCoinbase returns a coinbase transaction paying value to pkScript,
+// see testFixture.NewCoinbase
+func newTestCoinbase(tag uint32, value int64, pkScript []byte) *wire.MsgTx {
+  return testFixture.NewCoinbase(tag, value, pkScript)
+}
+
+// newTestBlock mines a block with txs on top of prev
+func newTestBlock(t *testing.T, prev chainhash.Hash, timestamp int64, txs ...*wire.MsgTx) *wire.MsgBlock {
+  return testFixture.NewBlock(t, prev, timestamp, testChainCfg.PowLimitBits, txs...)
+}
+
+// newTestBlockWithBits mines a block with txs on top of prev for the target
+// bits
+func newTestBlockWithBits(t *testing.T, prev chainhash.Hash, timestamp int64, bits uint32, txs ...*wire.MsgTx) *wire.MsgBlock {
+  return testFixture.NewBlock(t, prev, timestamp, bits, txs...)
+}
+
+// testRecord returns block in blk file format
+func testRecord(t *testing.T, block *wire.MsgBlock) []byte {
+  var buffer bytes.Buffer
+  header := make([]byte, 8)
+  binary.LittleEndian.PutUint32(header[0:4], uint32(testChainCfg.Net))
+  buffer.Write(header)
+  err := block.Serialize(&buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+  record := buffer.Bytes()
+  binary.LittleEndian.PutUint32(record[4:8], uint32(len(record)-8))
+  return record
+}
+
+// writeTestFile writes data to directory/name, obfuscated with xorKey like
+// Bitcoin Core does if xorKey is not nil
+func writeTestFile(t *testing.T, directory string, name string, xorKey []byte, data []byte) {
+  obfuscated := make([]byte, len(data))
+  copy(obfuscated, data)
+  for i := 0; i < len(xorKey) && len(obfuscated) > 0; i++ {
+    for j := i; j < len(obfuscated); j += len(xorKey) {
+      obfuscated[j] ^= xorKey[i]
+    }
+  }
+  err := ioutil.WriteFile(path.Join(directory, name), obfuscated, 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+// testHash returns the hash of block in the byte order of BlockInfo.Hash
+func testHash(block *wire.MsgBlock) [32]byte {
+  var hash [32]byte
+  blockHash := block.BlockHash()
+  copy(hash[:], blockHash[:])
+  ReverseBytes(hash[:])
+  return hash
+}
+
+// newTestParserOptions returns the default options without progress output
+func newTestParserOptions() *BitcoinBlockchainParserOptions {
+  options := NewBitcoinBlockchainParserDefaultOptions()
+  options.Progress = nil
+  return options
+}
+
+// testReporter collects the reported events
+type testReporter struct {
+  events []ProgressEvent
+}
+
+func (r *testReporter) Report(event ProgressEvent) {
+  r.events = append(r.events, event)
+}
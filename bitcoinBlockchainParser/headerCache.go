@@ -0,0 +1,294 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "github.com/pkg/errors"
+  "io"
+  "math/big"
+  "os"
+)
+
+// The header cache file starts with a header of magic, network, the end of
+// the scanned blk data and the record count, followed by fixed size records
+var headerCacheMagic = []byte("omnomhc1")
+
+const headerCacheHeaderSize = 8 + 4 + 2 + 8 + 4
+const headerCacheRecordSize = 32 + 32 + 8 + 2 + 4 + 4 + 4 + 4 + 4 + 4 + 32
+
+// headerCache keeps the block infos found in the blk files on disk, so a
+// restart only has to scan data appended since the last run. The first saved
+// block infos are on disk, those of them without chain work are written
+// again once it is known.
+type headerCache struct {
+  fileName        string
+  blkFileNumber   uint16
+  blkFilePosition int64
+  blockInfos      []*BlockInfo
+  byHash          map[[32]byte]*BlockInfo
+  saved           int
+  unknownWork     []int
+}
+
+// loadHeaderCache reads the cache from fileName. A missing file gives an
+// empty cache.
+func (bc *BitcoinBlockchainParser) loadHeaderCache(fileName string) (*headerCache, error) {
+  cache := new(headerCache)
+  cache.fileName = fileName
+  cache.byHash = make(map[[32]byte]*BlockInfo)
+
+  file, err := os.Open(fileName)
+  if os.IsNotExist(err) {
+    return cache, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  reader := bufio.NewReader(file)
+  header := make([]byte, headerCacheHeaderSize)
+  _, err = io.ReadFull(reader, header)
+  if err != nil {
+    return nil, errors.Wrap(err, "Reading header cache")
+  }
+  if !bytes.Equal(header[0:8], headerCacheMagic) {
+    return nil, errors.Errorf("%s is not a header cache", fileName)
+  }
+  if binary.LittleEndian.Uint32(header[8:12]) != uint32(bc.chainCfg.Net) {
+    return nil, errors.Errorf("Header cache %s belongs to another network", fileName)
+  }
+  cache.blkFileNumber = binary.LittleEndian.Uint16(header[12:14])
+  cache.blkFilePosition = int64(binary.LittleEndian.Uint64(header[14:22]))
+  count := int64(binary.LittleEndian.Uint32(header[22:26]))
+
+  fileInfo, err := file.Stat()
+  if err != nil {
+    return nil, err
+  }
+  if count > (fileInfo.Size()-headerCacheHeaderSize)/headerCacheRecordSize {
+    return nil, errors.Errorf("Header cache %s is truncated, %d records expected", fileName, count)
+  }
+
+  // records are unique, save only writes added block infos
+  cache.blockInfos = make([]*BlockInfo, 0, count)
+  record := make([]byte, headerCacheRecordSize)
+  for i := int64(0); i < count; i++ {
+    _, err = io.ReadFull(reader, record)
+    if err != nil {
+      return nil, errors.Wrap(err, "Reading header cache")
+    }
+    blockInfo := blockInfoFromCacheRecord(record)
+    if blockInfo.ChainWork == nil {
+      cache.unknownWork = append(cache.unknownWork, len(cache.blockInfos))
+    }
+    cache.blockInfos = append(cache.blockInfos, blockInfo)
+    cache.byHash[blockInfo.Hash] = blockInfo
+  }
+  cache.saved = len(cache.blockInfos)
+  return cache, nil
+}
+
+func (c *headerCache) add(blockInfo *BlockInfo) {
+  if _, ok := c.byHash[blockInfo.Hash]; ok {
+    return
+  }
+  c.blockInfos = append(c.blockInfos, blockInfo)
+  c.byHash[blockInfo.Hash] = blockInfo
+}
+
+// scannedUpTo records the end of the last record read from the blk files
+func (c *headerCache) scannedUpTo(blkFileNumber uint16, blkFilePosition int64) {
+  if blkFileNumber > c.blkFileNumber || (blkFileNumber == c.blkFileNumber && blkFilePosition > c.blkFilePosition) {
+    c.blkFileNumber = blkFileNumber
+    c.blkFilePosition = blkFilePosition
+  }
+}
+
+// save appends the block infos added since the last save and writes those
+// saved without chain work again if it is known now. The header with the
+// record count is written last, so an interrupted save leaves the previous
+// cache intact. A new cache is written to a temporary file and moved in
+// place.
+func (c *headerCache) save(chainCfgNet uint32) error {
+  fileName := c.fileName
+  flags := os.O_RDWR
+  if c.saved == 0 {
+    fileName += ".tmp"
+    flags |= os.O_CREATE | os.O_TRUNC
+  }
+  file, err := os.OpenFile(fileName, flags, 0644)
+  if err != nil {
+    return err
+  }
+
+  unknownWork, err := c.write(file, chainCfgNet)
+  closeErr := file.Close()
+  if err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    if c.saved == 0 {
+      os.Remove(fileName)
+    }
+    return err
+  }
+  if c.saved == 0 {
+    err = os.Rename(fileName, c.fileName)
+    if err != nil {
+      return err
+    }
+  }
+
+  c.saved = len(c.blockInfos)
+  c.unknownWork = unknownWork
+  return nil
+}
+
+// write writes the records and header for save and returns the indexes of
+// the records still without chain work
+func (c *headerCache) write(file *os.File, chainCfgNet uint32) ([]int, error) {
+  unknownWork := make([]int, 0)
+  record := make([]byte, headerCacheRecordSize)
+
+  for _, i := range c.unknownWork {
+    if c.blockInfos[i].ChainWork == nil {
+      unknownWork = append(unknownWork, i)
+      continue
+    }
+    c.blockInfos[i].toCacheRecord(record)
+    _, err := file.WriteAt(record, headerCacheHeaderSize+int64(i)*headerCacheRecordSize)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  _, err := file.Seek(headerCacheHeaderSize+int64(c.saved)*headerCacheRecordSize, io.SeekStart)
+  if err != nil {
+    return nil, err
+  }
+  writer := bufio.NewWriter(file)
+  for i := c.saved; i < len(c.blockInfos); i++ {
+    if c.blockInfos[i].ChainWork == nil {
+      unknownWork = append(unknownWork, i)
+    }
+    c.blockInfos[i].toCacheRecord(record)
+    _, err = writer.Write(record)
+    if err != nil {
+      return nil, err
+    }
+  }
+  err = writer.Flush()
+  if err != nil {
+    return nil, err
+  }
+  err = file.Sync()
+  if err != nil {
+    return nil, err
+  }
+
+  header := make([]byte, headerCacheHeaderSize)
+  copy(header[0:8], headerCacheMagic)
+  binary.LittleEndian.PutUint32(header[8:12], chainCfgNet)
+  binary.LittleEndian.PutUint16(header[12:14], c.blkFileNumber)
+  binary.LittleEndian.PutUint64(header[14:22], uint64(c.blkFilePosition))
+  binary.LittleEndian.PutUint32(header[22:26], uint32(len(c.blockInfos)))
+  _, err = file.WriteAt(header, 0)
+  if err != nil {
+    return nil, err
+  }
+  return unknownWork, file.Sync()
+}
+
+// saveHeaderCache persists the cache once heights and chain work are known.
+// Heights and chain work of a run starting after options.StopAtPrevHash are
+// only absolute if that block is cached, otherwise the cache is left as is.
+func (bc *BitcoinBlockchainParser) saveHeaderCache(options *BitcoinBlockchainParserOptions) error {
+  if bc.headerCache == nil {
+    return nil
+  }
+  if !allZero(options.StopAtPrevHash) && bc.headerCache.byHash[options.StopAtPrevHash] == nil {
+    options.report(HeaderCacheNotSavedEvent{"start block is not cached"})
+    return nil
+  }
+  return bc.headerCache.save(uint32(bc.chainCfg.Net))
+}
+
+// cachedParent returns the cached parent of blockInfo if its height and
+// chain work are known
+func (bc *BitcoinBlockchainParser) cachedParent(blockInfo *BlockInfo) *BlockInfo {
+  if bc.headerCache == nil {
+    return nil
+  }
+  parent := bc.headerCache.byHash[blockInfo.PrevHash]
+  if parent == nil || parent.ChainWork == nil {
+    return nil
+  }
+  return parent
+}
+
+// toCacheRecord serializes the fields kept in the header cache. Unknown chain
+// work is stored as zero.
+func (b *BlockInfo) toCacheRecord(record []byte) {
+  copy(record[0:32], b.Hash[:])
+  copy(record[32:64], b.PrevHash[:])
+  binary.LittleEndian.PutUint64(record[64:72], b.Height)
+  binary.LittleEndian.PutUint16(record[72:74], b.BlkFileNumber)
+  binary.LittleEndian.PutUint32(record[74:78], uint32(b.BlkFilePosition))
+  binary.LittleEndian.PutUint32(record[78:82], b.Size)
+  binary.LittleEndian.PutUint32(record[82:86], b.Version)
+  binary.LittleEndian.PutUint32(record[86:90], b.Timestamp)
+  binary.LittleEndian.PutUint32(record[90:94], b.Bits)
+  binary.LittleEndian.PutUint32(record[94:98], b.Status)
+  for i := 98; i < headerCacheRecordSize; i++ {
+    record[i] = 0
+  }
+  if b.ChainWork != nil {
+    b.ChainWork.FillBytes(record[98:130])
+  }
+}
+
+func blockInfoFromCacheRecord(record []byte) *BlockInfo {
+  blockInfo := new(BlockInfo)
+  copy(blockInfo.Hash[:], record[0:32])
+  copy(blockInfo.PrevHash[:], record[32:64])
+  blockInfo.Height = binary.LittleEndian.Uint64(record[64:72])
+  blockInfo.BlkFileNumber = binary.LittleEndian.Uint16(record[72:74])
+  blockInfo.BlkFilePosition = int32(binary.LittleEndian.Uint32(record[74:78]))
+  blockInfo.Size = binary.LittleEndian.Uint32(record[78:82])
+  blockInfo.Version = binary.LittleEndian.Uint32(record[82:86])
+  blockInfo.Timestamp = binary.LittleEndian.Uint32(record[86:90])
+  blockInfo.Bits = binary.LittleEndian.Uint32(record[90:94])
+  blockInfo.Status = binary.LittleEndian.Uint32(record[94:98])
+  chainWork := new(big.Int).SetBytes(record[98:130])
+  if chainWork.Sign() > 0 {
+    blockInfo.ChainWork = chainWork
+  }
+  return blockInfo
+}
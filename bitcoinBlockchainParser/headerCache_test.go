@@ -0,0 +1,217 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "encoding/binary"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path"
+  "reflect"
+  "testing"
+)
+
+// testCacheBlockInfo returns a block info with all cached fields set.
+// chainWork 0 leaves the chain work unknown.
+func testCacheBlockInfo(n byte, chainWork int64) *BlockInfo {
+  blockInfo := new(BlockInfo)
+  blockInfo.Hash[0] = n
+  blockInfo.PrevHash[0] = n - 1
+  blockInfo.Height = uint64(n)
+  blockInfo.BlkFileNumber = 1
+  blockInfo.BlkFilePosition = int32(n) * 1000
+  blockInfo.Size = 285
+  blockInfo.Version = 4
+  blockInfo.Timestamp = 1500000000 + uint32(n)
+  blockInfo.Bits = testChainCfg.PowLimitBits
+  blockInfo.Status = BlockValidTree
+  if chainWork > 0 {
+    blockInfo.ChainWork = big.NewInt(chainWork)
+  }
+  return blockInfo
+}
+
+func fileSize(t *testing.T, fileName string) int64 {
+  fileInfo, err := os.Stat(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return fileInfo.Size()
+}
+
+func TestHeaderCacheSaveAndLoad(t *testing.T) {
+  fileName := path.Join(t.TempDir(), "headers")
+  bc := NewBitcoinBlockchainParser(t.TempDir(), testChainCfg, nil, nil)
+
+  cache, err := bc.loadHeaderCache(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(cache.blockInfos) != 0 {
+    t.Fatalf("Missing cache has %d block infos", len(cache.blockInfos))
+  }
+
+  // block 2 is an orphan whose chain work is not known yet
+  cache.add(testCacheBlockInfo(1, 2))
+  cache.add(testCacheBlockInfo(2, 0))
+  cache.add(testCacheBlockInfo(1, 2))
+  cache.scannedUpTo(1, 2285)
+  cache.scannedUpTo(0, 9999)
+  err = cache.save(uint32(testChainCfg.Net))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if size := fileSize(t, fileName); size != headerCacheHeaderSize+2*headerCacheRecordSize {
+    t.Errorf("Cache has %d bytes", size)
+  }
+
+  loaded, err := bc.loadHeaderCache(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if loaded.blkFileNumber != 1 || loaded.blkFilePosition != 2285 {
+    t.Errorf("Scanned up to blk%.5d.dat:%d", loaded.blkFileNumber, loaded.blkFilePosition)
+  }
+  if !reflect.DeepEqual(loaded.blockInfos, cache.blockInfos) {
+    t.Errorf("Loaded %v, expected %v", loaded.blockInfos, cache.blockInfos)
+  }
+
+  // a later save appends block 3 and adds the chain work of block 2
+  loaded.blockInfos[1].ChainWork = big.NewInt(4)
+  loaded.add(testCacheBlockInfo(3, 6))
+  loaded.scannedUpTo(1, 3285)
+  err = loaded.save(uint32(testChainCfg.Net))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if size := fileSize(t, fileName); size != headerCacheHeaderSize+3*headerCacheRecordSize {
+    t.Errorf("Cache has %d bytes", size)
+  }
+
+  reloaded, err := bc.loadHeaderCache(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if reloaded.blkFilePosition != 3285 || len(reloaded.unknownWork) != 0 {
+    t.Errorf("Scanned up to %d, %d without chain work", reloaded.blkFilePosition, len(reloaded.unknownWork))
+  }
+  if !reflect.DeepEqual(reloaded.blockInfos, loaded.blockInfos) {
+    t.Errorf("Loaded %v, expected %v", reloaded.blockInfos, loaded.blockInfos)
+  }
+
+  mainnet := NewBitcoinBlockchainParser(t.TempDir(), &chaincfg.MainNetParams, nil, nil)
+  _, err = mainnet.loadHeaderCache(fileName)
+  if err == nil {
+    t.Error("Cache of another network loaded")
+  }
+}
+
+func TestHeaderCacheRecordCountBeyondFile(t *testing.T) {
+  fileName := path.Join(t.TempDir(), "headers")
+  bc := NewBitcoinBlockchainParser(t.TempDir(), testChainCfg, nil, nil)
+  cache, err := bc.loadHeaderCache(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cache.add(testCacheBlockInfo(1, 2))
+  err = cache.save(uint32(testChainCfg.Net))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  content, err := ioutil.ReadFile(fileName)
+  if err != nil {
+    t.Fatal(err)
+  }
+  binary.LittleEndian.PutUint32(content[22:26], 0xffffffff)
+  err = ioutil.WriteFile(fileName, content, 0644)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  _, err = bc.loadHeaderCache(fileName)
+  if err == nil {
+    t.Error("Truncated cache loaded")
+  }
+}
+
+func TestHeaderCacheResumesScan(t *testing.T) {
+  directory := t.TempDir()
+  block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, []byte{0x51}))
+  block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 50, []byte{0x51}))
+  record1 := testRecord(t, block1)
+  record2 := testRecord(t, block2)
+  writeTestFile(t, directory, "blk00000.dat", nil, record1)
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  options.HeaderCache = path.Join(t.TempDir(), "headers")
+
+  collect := func() []*BlockInfo {
+    blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = bc.FindChains(blockMap, blockOrder, options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return blockOrder
+  }
+  collect()
+
+  // block 1 is not read again, so damaging it goes unnoticed
+  damaged := append([]byte{}, record1...)
+  for i := 8; i < len(damaged); i++ {
+    damaged[i] = 0xee
+  }
+  writeTestFile(t, directory, "blk00000.dat", nil, append(damaged, record2...))
+
+  reporter := new(testReporter)
+  options.Progress = reporter
+  blockOrder := collect()
+  if len(blockOrder) != 2 || blockOrder[0].Hash != testHash(block1) || blockOrder[1].Hash != testHash(block2) || blockOrder[1].Height != 1 {
+    t.Fatalf("Found %v", blockOrder)
+  }
+
+  loaded := false
+  for _, event := range reporter.events {
+    switch event := event.(type) {
+    case HeaderCacheLoadedEvent:
+      loaded = true
+      if event.Blocks != 1 || event.FileNumber != 0 || event.FilePosition != int64(len(record1)) {
+        t.Errorf("Reported %+v", event)
+      }
+    case SkippedRegionEvent:
+      t.Errorf("Reported %+v", event)
+    }
+  }
+  if !loaded {
+    t.Error("Cache not loaded")
+  }
+}
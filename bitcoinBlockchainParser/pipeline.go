@@ -0,0 +1,334 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "context"
+  "encoding/binary"
+  "fmt"
+  "github.com/pkg/errors"
+  "io"
+  "path"
+  "sync"
+  "time"
+)
+
+// decodeJob carries one raw block record from the reading goroutine to a
+// decode worker and from there, in chain order, to the callbacks
+type decodeJob struct {
+  blockInfo *BlockInfo
+  raw       []byte
+  undo      []byte
+  block     *Block
+  bytesUsed int
+  err       error
+  done      chan struct{}
+}
+
+// BlockResult is one block delivered by Blocks. Block is nil if it was
+// skipped by options.OnDecodeError, Err ends the stream.
+type BlockResult struct {
+  BlockInfo *BlockInfo
+  Block     *Block
+  Err       error
+}
+
+// Blocks is the pull style counterpart of ParseBlocks. The blocks of chain
+// are read and decoded ahead on options.DecodeWorkers goroutines and sent
+// in chain order. The channel is closed after the last block, after an
+// error or when ctx is done, so a consumer stopping early must cancel ctx.
+func (bc *BitcoinBlockchainParser) Blocks(ctx context.Context, chain *Chain, options *BitcoinBlockchainParserOptions) <-chan *BlockResult {
+  if chain == nil {
+    return errorResult(errors.New("No chain specified"))
+  }
+
+  chain.walkBack(options.StopAtPrevHash)
+
+  err := bc.loadXorKey()
+  if err != nil {
+    return errorResult(err)
+  }
+  return bc.blocksFrom(ctx, chain.First, options)
+}
+
+// parseBlocksParallel passes the blocks delivered by blocksFrom to the
+// callbacks. At most options.PrefetchWindow blocks are held in memory at
+// any time.
+func (bc *BitcoinBlockchainParser) parseBlocksParallel(chain *Chain, options *BitcoinBlockchainParserOptions) error {
+  ctx, cancel := context.WithCancel(context.Background())
+  results := bc.blocksFrom(ctx, chain.First, options)
+
+  var err error
+  blockCount := 0
+  var bytesRead int64
+  start := time.Now()
+
+  for result := range results {
+    if result.Err != nil {
+      err = result.Err
+      break
+    }
+
+    // like the sequential path, the block info is passed on even if the
+    // block was skipped
+    if options.CallBlockInfoCallback && bc.onBlockInfo != nil {
+      err = bc.onBlockInfo(blockCount, chain.Length, result.BlockInfo)
+      if err != nil {
+        break
+      }
+    }
+
+    if result.Block == nil {
+      blockCount++
+      continue
+    }
+    bytesRead += int64(result.Block.Size) + 8
+
+    if bc.onBlock != nil {
+      err = bc.onBlock(blockCount, chain.Length, result.Block)
+      if err != nil {
+        break
+      }
+    }
+
+    if blockCount != 0 && blockCount%1000 == 0 {
+      options.report(newBlocksScannedEvent(StageParse, blockCount, chain.Length, bytesRead, start, false))
+    }
+    blockCount++
+  }
+
+  // the channel is closed once all goroutines are done
+  cancel()
+  for range results {
+  }
+
+  if err != nil {
+    return err
+  }
+
+  options.report(newBlocksScannedEvent(StageParse, blockCount, chain.Length, bytesRead, start, true))
+  return nil
+}
+
+// blocksFrom reads block records sequentially from blockInfo on along the
+// chain, decodes them on options.DecodeWorkers goroutines and sends them in
+// chain order
+func (bc *BitcoinBlockchainParser) blocksFrom(ctx context.Context, blockInfo *BlockInfo, options *BitcoinBlockchainParserOptions) <-chan *BlockResult {
+  results := make(chan *BlockResult)
+
+  workerCount := options.DecodeWorkers
+  if workerCount < 1 {
+    workerCount = 1
+  }
+  window := options.PrefetchWindow
+  if window < workerCount {
+    window = workerCount
+  }
+
+  go func() {
+    defer close(results)
+
+    ordered := make(chan *decodeJob, window)
+    work := make(chan *decodeJob)
+    quit := make(chan struct{})
+
+    var workers sync.WaitGroup
+    for i := 0; i < workerCount; i++ {
+      workers.Add(1)
+      go func() {
+        defer workers.Done()
+        for job := range work {
+          bc.decodeJob(job, options)
+        }
+      }()
+    }
+    defer workers.Wait()
+    defer close(quit)
+
+    go bc.readJobs(blockInfo, options, ordered, work, quit)
+
+    for job := range ordered {
+      select {
+      case <-job.done:
+      case <-ctx.Done():
+        return
+      }
+
+      result := &BlockResult{BlockInfo: job.blockInfo}
+      quarantined, err := bc.quarantineBlock(job.blockInfo, job.err, options)
+      if err == nil && !quarantined && int(job.block.Size) != job.bytesUsed-8 {
+        err = errors.New("Data mismatch")
+      }
+      if err != nil {
+        result.Err = err
+      } else if !quarantined {
+        result.Block = job.block
+      }
+
+      select {
+      case results <- result:
+      case <-ctx.Done():
+        return
+      }
+      if err != nil {
+        return
+      }
+    }
+  }()
+  return results
+}
+
+func errorResult(err error) <-chan *BlockResult {
+  results := make(chan *BlockResult, 1)
+  results <- &BlockResult{Err: err}
+  close(results)
+  return results
+}
+
+// readJobs walks the chain forward and reads the raw record of every block.
+// Each job is queued in ordered first, so a full prefetch window blocks
+// reading until the callbacks caught up.
+func (bc *BitcoinBlockchainParser) readJobs(blockInfo *BlockInfo, options *BitcoinBlockchainParserOptions, ordered chan<- *decodeJob, work chan<- *decodeJob, quit <-chan struct{}) {
+  defer close(ordered)
+  defer close(work)
+
+  var fileName string
+  var file blockFile
+  header := make([]byte, 8)
+  magic := make([]byte, 4)
+  binary.LittleEndian.PutUint32(magic, uint32(bc.chainCfg.Net))
+
+  defer func() {
+    if file != nil {
+      file.Close()
+    }
+  }()
+
+  var undo *undoReader
+  if options.ResolvePrevOuts {
+    undo = newUndoReader(bc)
+    defer undo.close()
+  }
+
+  for ; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    job := new(decodeJob)
+    job.blockInfo = blockInfo
+    job.done = make(chan struct{})
+
+    select {
+    case ordered <- job:
+    case <-quit:
+      return
+    }
+
+    oldFileName := fileName
+    fileName = path.Join(bc.directory, fmt.Sprintf("blk%.5d.dat", blockInfo.BlkFileNumber))
+
+    if oldFileName != fileName {
+      if file != nil {
+        file.Close()
+      }
+      file, job.err = bc.openBlockFile(fileName)
+      if job.err != nil {
+        file = nil
+        close(job.done)
+        return
+      }
+    }
+
+    job.raw, job.err = readRecord(file, int64(blockInfo.BlkFilePosition), header, magic)
+    if job.err != nil {
+      close(job.done)
+      return
+    }
+
+    if undo != nil {
+      job.undo, job.err = undo.readUndo(blockInfo)
+      if job.err != nil {
+        close(job.done)
+        return
+      }
+    }
+
+    select {
+    case work <- job:
+    case <-quit:
+      return
+    }
+  }
+}
+
+func (bc *BitcoinBlockchainParser) decodeJob(job *decodeJob, options *BitcoinBlockchainParserOptions) {
+  defer close(job.done)
+
+  reader := newBlockReader(bytes.NewReader(job.raw), fmt.Sprintf("blk%.5d.dat", job.blockInfo.BlkFileNumber), bc.chainCfg)
+  reader.position = int(job.blockInfo.BlkFilePosition)
+
+  job.block, job.bytesUsed, job.err = reader.parseBlock()
+  if job.err == nil && job.block == nil {
+    job.err = errors.New("No block data")
+  }
+  if job.err == nil && options.VerifyBlocks {
+    job.err = VerifyBlock(job.block)
+  }
+  if job.err == nil && job.undo != nil {
+    job.err = resolvePrevOutsFromUndo(job.block, job.undo, bc.chainCfg)
+  }
+  job.raw = nil
+  job.undo = nil
+}
+
+// readRecord reads a whole blk file record (magic, size and block data)
+// starting at position
+func readRecord(file blockFile, position int64, header []byte, magic []byte) ([]byte, error) {
+  _, err := file.Seek(position, 0)
+  if err != nil {
+    return nil, err
+  }
+
+  _, err = io.ReadFull(file, header)
+  if err != nil {
+    return nil, err
+  }
+
+  if !bytes.Equal(header[0:4], magic) {
+    return nil, errors.Errorf("Invalid magic at offset %d", position)
+  }
+
+  size := binary.LittleEndian.Uint32(header[4:8])
+  if size > maxBlockSerializedSize {
+    return nil, errors.Errorf("Invalid size %d at offset %d", size, position)
+  }
+  raw := make([]byte, 8+int(size))
+  copy(raw, header)
+
+  _, err = io.ReadFull(file, raw[8:])
+  if err != nil {
+    return nil, err
+  }
+  return raw, nil
+}
@@ -0,0 +1,239 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "context"
+  "encoding/binary"
+  "fmt"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "reflect"
+  "runtime"
+  "testing"
+  "time"
+)
+
+// writeTestChain writes a chain of count blocks, perFile records per blk
+// file, and returns the records
+func writeTestChain(t *testing.T, directory string, count int, perFile int) [][]byte {
+  records := make([][]byte, 0, count)
+  prev := chainhash.Hash{}
+  for i := 0; i < count; i++ {
+    block := newTestBlock(t, prev, 1500000000+int64(i)*600, newTestCoinbase(uint32(i), 50, []byte{0x51}))
+    records = append(records, testRecord(t, block))
+    prev = block.BlockHash()
+  }
+  writeTestRecords(t, directory, records, perFile)
+  return records
+}
+
+func writeTestRecords(t *testing.T, directory string, records [][]byte, perFile int) {
+  for i := 0; i*perFile < len(records); i++ {
+    data := make([]byte, 0)
+    for j := i * perFile; j < (i+1)*perFile && j < len(records); j++ {
+      data = append(data, records[j]...)
+    }
+    writeTestFile(t, directory, fmt.Sprintf("blk%.5d.dat", i), nil, data)
+  }
+}
+
+// corruptTestRecord makes the transaction count of a record claim more
+// transactions than the record holds
+func corruptTestRecord(record []byte) {
+  record[8+wire.MaxBlockHeaderPayload] = 0xfe
+  binary.LittleEndian.PutUint32(record[8+wire.MaxBlockHeaderPayload+1:], 0xffffffff)
+}
+
+func TestParseBlocksWorkersAgree(t *testing.T) {
+  directory := t.TempDir()
+  records := writeTestChain(t, directory, 9, 4)
+  corruptTestRecord(records[5])
+  writeTestRecords(t, directory, records, 4)
+
+  parse := func(workers int) []string {
+    calls := make([]string, 0)
+    bc := NewBitcoinBlockchainParser(directory, testChainCfg, func(number int, count int, blockInfo *BlockInfo) error {
+      calls = append(calls, fmt.Sprintf("info %d/%d %x", number, count, blockInfo.Hash))
+      return nil
+    }, func(number int, count int, block *Block) error {
+      calls = append(calls, fmt.Sprintf("block %d/%d %x", number, count, block.Hash))
+      return nil
+    })
+    options := newTestParserOptions()
+    options.DecodeWorkers = workers
+    options.PrefetchWindow = 2
+    options.OnDecodeError = func(*BlockInfo, *DecodeError) error {
+      return nil
+    }
+
+    blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    chains, err := bc.FindChains(blockMap, blockOrder, options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = bc.ParseBlocks(chains[0], options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return calls
+  }
+
+  sequential := parse(1)
+  // 9 block infos and all blocks but the skipped one
+  if len(sequential) != 17 {
+    t.Fatalf("%d callbacks: %v", len(sequential), sequential)
+  }
+  for _, workers := range []int{2, 4, 16} {
+    if parallel := parse(workers); !reflect.DeepEqual(parallel, sequential) {
+      t.Errorf("%d workers: %v, expected %v", workers, parallel, sequential)
+    }
+  }
+}
+
+func TestBlocksReadsAheadAtMostPrefetchWindow(t *testing.T) {
+  directory := t.TempDir()
+  records := writeTestChain(t, directory, 12, 5)
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  options.DecodeWorkers = 4
+  options.PrefetchWindow = 4
+  options.OnDecodeError = func(*BlockInfo, *DecodeError) error {
+    return nil
+  }
+  blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chains, err := bc.FindChains(blockMap, blockOrder, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  results := bc.Blocks(ctx, chains[0], options)
+  first := <-results
+  if first.Err != nil || first.Block == nil {
+    t.Fatalf("First result %+v", first)
+  }
+
+  // give the reader time to fill the window, then damage every record.
+  // Blocks read before are delivered intact, later ones are skipped.
+  time.Sleep(100 * time.Millisecond)
+  for _, record := range records {
+    corruptTestRecord(record)
+  }
+  writeTestRecords(t, directory, records, 5)
+
+  intact := 0
+  number := 1
+  for result := range results {
+    if result.Err != nil {
+      t.Fatal(result.Err)
+    }
+    if result.BlockInfo != blockOrder[number] {
+      t.Fatalf("Result %d is block %x", number, result.BlockInfo.Hash)
+    }
+    if result.Block != nil {
+      if result.Block.Hash != result.BlockInfo.Hash || intact != number-1 {
+        t.Errorf("Block %d delivered after a skipped one", number)
+      }
+      intact++
+    }
+    number++
+  }
+  if number != len(records) {
+    t.Errorf("%d results", number)
+  }
+  // the window is full and the one block being handed over is held back
+  if intact > options.PrefetchWindow+1 {
+    t.Errorf("%d blocks read ahead, window is %d", intact, options.PrefetchWindow)
+  }
+}
+
+func TestBlocksStopsWhenCancelled(t *testing.T) {
+  directory := t.TempDir()
+  records := writeTestChain(t, directory, 40, 10)
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  options := newTestParserOptions()
+  options.DecodeWorkers = 4
+  options.PrefetchWindow = 2
+  blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  chains, err := bc.FindChains(blockMap, blockOrder, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  goroutines := runtime.NumGoroutine()
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  results := bc.Blocks(ctx, chains[0], options)
+  for i := 0; i < 3; i++ {
+    result := <-results
+    if result == nil || result.Err != nil || result.BlockInfo != blockOrder[i] {
+      t.Fatalf("Result %d %+v", i, result)
+    }
+  }
+  cancel()
+
+  received := 3
+  timeout := time.After(5 * time.Second)
+  for closed := false; !closed; {
+    select {
+    case result, ok := <-results:
+      if !ok {
+        closed = true
+        break
+      }
+      if result.Err != nil {
+        t.Fatal(result.Err)
+      }
+      received++
+    case <-timeout:
+      t.Fatal("Channel not closed after cancel")
+    }
+  }
+  if received == len(records) {
+    t.Errorf("All %d blocks delivered after cancel", received)
+  }
+
+  // the reading goroutine leaves right after the channel is closed
+  deadline := time.Now().Add(time.Second)
+  for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+    time.Sleep(10 * time.Millisecond)
+  }
+  if runtime.NumGoroutine() > goroutines {
+    t.Errorf("%d goroutines left running, %d before", runtime.NumGoroutine(), goroutines)
+  }
+}
@@ -0,0 +1,213 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "fmt"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg"
+  "math/big"
+)
+
+// InvalidHeaderError is reported for headers which do not meet their own
+// target or do not follow the network's retarget rules
+type InvalidHeaderError struct {
+  Hash   [32]byte
+  Height uint64
+  Reason string
+}
+
+func (e *InvalidHeaderError) Error() string {
+  return fmt.Sprintf("Invalid header %x at height %d: %s", e.Hash, e.Height, e.Reason)
+}
+
+// connectHeaders assigns height and cumulative chain work to tip and all of
+// its ancestors which have none yet, and checks each header on the way.
+// Blocks failing a check are flagged BlockFailedValid, their descendants
+// BlockFailedChild. Heights counted from options.StartBlockHeight without a
+// cached parent are assumed, so only the proof of work is checked then.
+func (bc *BitcoinBlockchainParser) connectHeaders(tip *BlockInfo, options *BitcoinBlockchainParserOptions) {
+  path := make([]*BlockInfo, 0)
+  for blockInfo := tip; blockInfo != nil && blockInfo.ChainWork == nil; blockInfo = blockInfo.PrevBlockInfo {
+    path = append(path, blockInfo)
+    if bytes.Equal(blockInfo.PrevHash[0:32], options.StopAtPrevHash[0:32]) {
+      break
+    }
+  }
+  if len(path) == 0 {
+    return
+  }
+  assumedHeights := bc.heightsAssumed(path[len(path)-1], options)
+
+  for i := len(path) - 1; i >= 0; i-- {
+    blockInfo := path[i]
+    prev := blockInfo.PrevBlockInfo
+    if bytes.Equal(blockInfo.PrevHash[0:32], options.StopAtPrevHash[0:32]) {
+      prev = nil
+    }
+
+    work := blockchain.CalcWork(blockInfo.Bits)
+    if parent := bc.cachedParent(blockInfo); prev == nil && parent != nil {
+      // the block before the window is known from the header cache
+      blockInfo.Height = parent.Height + 1
+      blockInfo.ChainWork = work.Add(work, parent.ChainWork)
+    } else if prev == nil {
+      blockInfo.Height = options.StartBlockHeight
+      blockInfo.ChainWork = work
+    } else {
+      blockInfo.Height = prev.Height + 1
+      blockInfo.ChainWork = work.Add(work, prev.ChainWork)
+    }
+
+    if prev != nil && prev.Status&BlockFailedMask != 0 {
+      blockInfo.Status |= BlockFailedChild
+      continue
+    }
+
+    checkPrev := prev
+    if assumedHeights {
+      checkPrev = nil
+    }
+    err := CheckHeader(blockInfo, checkPrev, bc.chainCfg)
+    if err != nil {
+      reason := err.Error()
+      if invalidHeader, ok := err.(*InvalidHeaderError); ok {
+        reason = invalidHeader.Reason
+      }
+      options.report(InvalidHeaderEvent{fmt.Sprintf("%x", blockInfo.Hash), blockInfo.Height, reason})
+      blockInfo.Status |= BlockFailedValid
+      continue
+    }
+    if blockInfo.Status&BlockValidMask < BlockValidTree {
+      blockInfo.Status = blockInfo.Status&^BlockValidMask | BlockValidTree
+    }
+  }
+}
+
+// heightsAssumed tells whether the heights of blockInfo and its ancestors
+// were counted from options.StartBlockHeight, because the parent of the
+// first of them is neither the genesis block's zero hash nor cached
+func (bc *BitcoinBlockchainParser) heightsAssumed(blockInfo *BlockInfo, options *BitcoinBlockchainParserOptions) bool {
+  if allZero(options.StopAtPrevHash) {
+    return false
+  }
+  for blockInfo.PrevBlockInfo != nil && !bytes.Equal(blockInfo.PrevHash[0:32], options.StopAtPrevHash[0:32]) {
+    blockInfo = blockInfo.PrevBlockInfo
+  }
+  return bc.cachedParent(blockInfo) == nil
+}
+
+// CheckHeader checks the proof of work against the claimed target and,
+// when enough ancestors are linked through PrevBlockInfo, the claimed target
+// against the one required by the retarget rules. prev may be nil if the
+// parent is unknown. A block info without header fields, like one loaded
+// from an old index, has Bits 0 and counts as unknown too.
+func CheckHeader(blockInfo *BlockInfo, prev *BlockInfo, chainCfg *chaincfg.Params) error {
+  target := blockchain.CompactToBig(blockInfo.Bits)
+  if target.Sign() <= 0 || target.Cmp(chainCfg.PowLimit) > 0 {
+    return &InvalidHeaderError{blockInfo.Hash, blockInfo.Height, fmt.Sprintf("target %08x out of range", blockInfo.Bits)}
+  }
+
+  // Hash is stored in display order, which is big endian
+  hash := new(big.Int).SetBytes(blockInfo.Hash[:])
+  if hash.Cmp(target) > 0 {
+    return &InvalidHeaderError{blockInfo.Hash, blockInfo.Height, fmt.Sprintf("hash above target %08x", blockInfo.Bits)}
+  }
+
+  if prev == nil {
+    return nil
+  }
+
+  requiredBits, known := requiredBits(blockInfo, prev, chainCfg)
+  if known && requiredBits != blockInfo.Bits {
+    return &InvalidHeaderError{blockInfo.Hash, blockInfo.Height, fmt.Sprintf("bits %08x, expected %08x", blockInfo.Bits, requiredBits)}
+  }
+  return nil
+}
+
+// requiredBits follows Bitcoin Core's GetNextWorkRequired. It returns false
+// if an ancestor needed to compute the target is not linked or has no
+// header fields.
+func requiredBits(blockInfo *BlockInfo, prev *BlockInfo, chainCfg *chaincfg.Params) (uint32, bool) {
+  targetTimespan := int64(chainCfg.TargetTimespan.Seconds())
+  interval := uint64(targetTimespan / int64(chainCfg.TargetTimePerBlock.Seconds()))
+
+  if prev.Bits == 0 {
+    return 0, false
+  }
+
+  // regtest never retargets
+  if chainCfg.Net == chaincfg.RegressionNetParams.Net {
+    return prev.Bits, true
+  }
+
+  if blockInfo.Height%interval != 0 {
+    if !chainCfg.ReduceMinDifficulty {
+      return prev.Bits, true
+    }
+
+    // a block more than MinDiffReductionTime after its parent may use the
+    // minimum difficulty
+    if int64(blockInfo.Timestamp) > int64(prev.Timestamp)+int64(chainCfg.MinDiffReductionTime.Seconds()) {
+      return chainCfg.PowLimitBits, true
+    }
+
+    // otherwise the last target which was not the minimum applies
+    ancestor := prev
+    for ancestor.Height%interval != 0 && ancestor.Bits == chainCfg.PowLimitBits {
+      if ancestor.PrevBlockInfo == nil || ancestor.PrevBlockInfo.Bits == 0 {
+        return 0, false
+      }
+      ancestor = ancestor.PrevBlockInfo
+    }
+    return ancestor.Bits, true
+  }
+
+  first := prev
+  for i := uint64(0); i < interval-1; i++ {
+    if first.PrevBlockInfo == nil || first.PrevBlockInfo.Bits == 0 {
+      return 0, false
+    }
+    first = first.PrevBlockInfo
+  }
+
+  timespan := int64(prev.Timestamp) - int64(first.Timestamp)
+  if timespan < targetTimespan/chainCfg.RetargetAdjustmentFactor {
+    timespan = targetTimespan / chainCfg.RetargetAdjustmentFactor
+  }
+  if timespan > targetTimespan*chainCfg.RetargetAdjustmentFactor {
+    timespan = targetTimespan * chainCfg.RetargetAdjustmentFactor
+  }
+
+  target := blockchain.CompactToBig(prev.Bits)
+  target.Mul(target, big.NewInt(timespan))
+  target.Div(target, big.NewInt(targetTimespan))
+  if target.Cmp(chainCfg.PowLimit) > 0 {
+    target.Set(chainCfg.PowLimit)
+  }
+  return blockchain.BigToCompact(target), true
+}
@@ -0,0 +1,210 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "github.com/btcsuite/btcd/chaincfg"
+  "testing"
+)
+
+// testRetargetWindow links a retarget window of block infos ending at the
+// block before height, which must be a multiple of 2016. The first block of
+// the window has timestamp first, the last one timestamp last.
+func testRetargetWindow(height uint64, bits uint32, first uint32, last uint32) *BlockInfo {
+  var prev *BlockInfo
+  for h := height - 2016; h < height; h++ {
+    blockInfo := &BlockInfo{Height: h, Bits: bits, Timestamp: first, PrevBlockInfo: prev}
+    prev = blockInfo
+  }
+  prev.Timestamp = last
+  return prev
+}
+
+func TestRequiredBitsMainnetRetarget(t *testing.T) {
+  // Bitcoin Core's pow_tests
+  tests := []struct {
+    name     string
+    height   uint64
+    bits     uint32
+    first    uint32
+    last     uint32
+    expected uint32
+  }{
+    {"block 32256", 32256, 0x1d00ffff, 1261130161, 1262152739, 0x1d00d86a},
+    {"pow limit", 2016, 0x1d00ffff, 1231006505, 1233061996, 0x1d00ffff},
+    // blocks 66528 to 68543 took less than a quarter of two weeks
+    {"quarter timespan", 68544, 0x1c05a3f4, 1279008237, 1279297671, 0x1c0168fd},
+    // more than four times two weeks
+    {"fourfold timespan", 46368, 0x1c387f6f, 1263163443, 1269211443, 0x1d00e1fd},
+  }
+  for _, test := range tests {
+    prev := testRetargetWindow(test.height, test.bits, test.first, test.last)
+    blockInfo := &BlockInfo{Height: test.height, Timestamp: test.last + 600}
+    bits, known := requiredBits(blockInfo, prev, &chaincfg.MainNetParams)
+    if !known || bits != test.expected {
+      t.Errorf("%s: %08x %v, expected %08x", test.name, bits, known, test.expected)
+    }
+  }
+
+  // between retargets the bits stay the same, at a retarget the whole
+  // window must be known
+  prev := testRetargetWindow(32256, 0x1d00ffff, 1261130161, 1262152739)
+  bits, known := requiredBits(&BlockInfo{Height: 32255}, prev.PrevBlockInfo, &chaincfg.MainNetParams)
+  if !known || bits != 0x1d00ffff {
+    t.Errorf("Between retargets %08x %v", bits, known)
+  }
+  prev.PrevBlockInfo.PrevBlockInfo = nil
+  _, known = requiredBits(&BlockInfo{Height: 32256}, prev, &chaincfg.MainNetParams)
+  if known {
+    t.Error("Retarget without the whole window")
+  }
+}
+
+func TestRequiredBitsTestnetMinDifficulty(t *testing.T) {
+  cfg := &chaincfg.TestNet3Params
+  minBits := cfg.PowLimitBits
+  reduction := uint32(cfg.MinDiffReductionTime.Seconds())
+
+  // a retarget block with real difficulty followed by minimum difficulty
+  // blocks
+  retarget := &BlockInfo{Height: 4032, Bits: 0x1c00ffff, Timestamp: 1500000000}
+  prev := retarget
+  for h := uint64(4033); h < 4036; h++ {
+    prev = &BlockInfo{Height: h, Bits: minBits, Timestamp: prev.Timestamp + reduction + 1, PrevBlockInfo: prev}
+  }
+
+  tests := []struct {
+    name      string
+    timestamp uint32
+    expected  uint32
+  }{
+    {"late block", prev.Timestamp + reduction + 1, minBits},
+    {"block in time", prev.Timestamp + 60, 0x1c00ffff},
+  }
+  for _, test := range tests {
+    bits, known := requiredBits(&BlockInfo{Height: 4036, Timestamp: test.timestamp}, prev, cfg)
+    if !known || bits != test.expected {
+      t.Errorf("%s: %08x %v, expected %08x", test.name, bits, known, test.expected)
+    }
+  }
+
+  // the walk back stops at a retarget block even if it has minimum
+  // difficulty
+  retarget.Bits = minBits
+  retarget.PrevBlockInfo = &BlockInfo{Height: 4031, Bits: 0x1c00ffff}
+  bits, known := requiredBits(&BlockInfo{Height: 4036, Timestamp: prev.Timestamp + 60}, prev, cfg)
+  if !known || bits != minBits {
+    t.Errorf("Walked back past the retarget block: %08x %v", bits, known)
+  }
+
+  // an unknown ancestor leaves the bits unknown
+  retarget.PrevBlockInfo = nil
+  retarget.Height = 4030
+  _, known = requiredBits(&BlockInfo{Height: 4036, Timestamp: prev.Timestamp + 60}, prev, cfg)
+  if known {
+    t.Error("Walked back past an unknown ancestor")
+  }
+}
+
+// testHeaderInfo returns a block info whose hash is n, which is below every
+// target
+func testHeaderInfo(n byte, prev *BlockInfo, bits uint32, timestamp uint32) *BlockInfo {
+  blockInfo := &BlockInfo{Bits: bits, Timestamp: timestamp}
+  blockInfo.Hash[31] = n
+  if prev != nil {
+    blockInfo.PrevHash = prev.Hash
+  }
+  return blockInfo
+}
+
+func TestFindChainsRanksByWork(t *testing.T) {
+  cfg := &chaincfg.TestNet3Params
+  reduction := uint32(cfg.MinDiffReductionTime.Seconds())
+
+  // a long branch of minimum difficulty blocks and a short one keeping the
+  // difficulty of the shared first block
+  first := testHeaderInfo(1, nil, 0x1c00ffff, 1500000000)
+  blockOrder := []*BlockInfo{first}
+  prev := first
+  for n := byte(2); n < 7; n++ {
+    prev = testHeaderInfo(n, prev, cfg.PowLimitBits, prev.Timestamp+reduction+1)
+    blockOrder = append(blockOrder, prev)
+  }
+  long := prev
+  prev = first
+  for n := byte(12); n < 14; n++ {
+    prev = testHeaderInfo(n, prev, 0x1c00ffff, prev.Timestamp+600)
+    blockOrder = append(blockOrder, prev)
+  }
+  short := prev
+
+  blockMap := make(map[[32]byte]*BlockInfo)
+  for _, blockInfo := range blockOrder {
+    blockMap[blockInfo.Hash] = blockInfo
+  }
+
+  bc := NewBitcoinBlockchainParser(t.TempDir(), cfg, nil, nil)
+  chains, err := bc.FindChains(blockMap, blockOrder, newTestParserOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 2 || chains[0].Last != short || chains[1].Last != long {
+    t.Fatalf("Found %v", chains)
+  }
+  if short.Height != 2 || long.Height != 5 || short.ChainWork.Cmp(long.ChainWork) <= 0 {
+    t.Errorf("Heights %d and %d, work %v and %v", short.Height, long.Height, short.ChainWork, long.ChainWork)
+  }
+}
+
+func TestConnectHeadersSkipsRetargetAfterUnknownParent(t *testing.T) {
+  // the parent of the first block is neither indexed nor cached, its real
+  // height is a retarget
+  var parentHash [32]byte
+  parentHash[0] = 0xaa
+  first := testHeaderInfo(1, nil, 0x1c00ffff, 1500000000)
+  first.PrevHash = parentHash
+  second := testHeaderInfo(2, first, 0x1c00fffe, 1500000600)
+  second.PrevBlockInfo = first
+
+  options := newTestParserOptions()
+  options.StopAtPrevHash = parentHash
+  bc := NewBitcoinBlockchainParser(t.TempDir(), &chaincfg.MainNetParams, nil, nil)
+  bc.connectHeaders(second, options)
+  if first.Status&BlockFailedMask != 0 || second.Status&BlockFailedMask != 0 {
+    t.Errorf("Flagged %d and %d", first.Status, second.Status)
+  }
+  if first.Height != 0 || second.Height != 1 || second.ChainWork == nil {
+    t.Errorf("Heights %d and %d", first.Height, second.Height)
+  }
+
+  // the proof of work is still checked
+  third := testHeaderInfo(3, second, 0x1c00fffe, 1500001200)
+  third.Hash[0] = 0xff
+  third.PrevBlockInfo = second
+  bc.connectHeaders(third, options)
+  if third.Status&BlockFailedValid == 0 {
+    t.Error("Hash above target accepted")
+  }
+}
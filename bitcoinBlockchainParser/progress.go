@@ -0,0 +1,315 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "sync"
+  "time"
+)
+
+// Stages reported by BlocksScannedEvent
+const (
+  StageScan  = "scan"
+  StageParse = "parse"
+)
+
+// ProgressReporter receives the events of CollectBlockInfo, FindChains,
+// ParseBlocks and the block sources. Events of the parallel decoder are
+// reported from several goroutines, so implementations must be safe for
+// concurrent use.
+type ProgressReporter interface {
+  Report(event ProgressEvent)
+}
+
+// ProgressEvent is one of the *Event types below. Name identifies the type
+// in machine readable output, String is the line written to a log.
+type ProgressEvent interface {
+  fmt.Stringer
+  Name() string
+}
+
+// FileOpenedEvent is reported when a blk file or Core's block index is
+// opened. Number and Count are 0 for the block index.
+type FileOpenedEvent struct {
+  File   string `json:"file"`
+  Number int    `json:"number"`
+  Count  int    `json:"count"`
+}
+
+func (e FileOpenedEvent) Name() string { return "file_opened" }
+
+func (e FileOpenedEvent) String() string {
+  if e.Count == 0 {
+    return fmt.Sprintf("Opening %s", e.File)
+  }
+  return fmt.Sprintf("Opening %s [%d of %d]", e.File, e.Number, e.Count)
+}
+
+// HeaderCacheLoadedEvent is reported when the header cache was read and
+// scanning continues after the cached part of the blk files
+type HeaderCacheLoadedEvent struct {
+  Blocks       int   `json:"blocks"`
+  FileNumber   int   `json:"fileNumber"`
+  FilePosition int64 `json:"filePosition"`
+}
+
+func (e HeaderCacheLoadedEvent) Name() string { return "header_cache_loaded" }
+
+func (e HeaderCacheLoadedEvent) String() string {
+  return fmt.Sprintf("Loaded %d cached blocks, scanning from blk%.5d.dat:%d", e.Blocks, e.FileNumber, e.FilePosition)
+}
+
+// HeaderCacheNotSavedEvent is reported when the header cache is left as is
+// after finding the chains
+type HeaderCacheNotSavedEvent struct {
+  Reason string `json:"reason"`
+}
+
+func (e HeaderCacheNotSavedEvent) Name() string { return "header_cache_not_saved" }
+
+func (e HeaderCacheNotSavedEvent) String() string {
+  return fmt.Sprintf("Not updating header cache, %s", e.Reason)
+}
+
+// BlocksScannedEvent reports how far scanning the headers or parsing the
+// blocks of a chain got. Total and ETA are 0 if the number of blocks is not
+// known in advance, Done is set on the last event of a stage.
+type BlocksScannedEvent struct {
+  Stage           string        `json:"stage"`
+  Blocks          int           `json:"blocks"`
+  Total           int           `json:"total"`
+  Bytes           int64         `json:"bytes"`
+  Elapsed         time.Duration `json:"elapsedNanos"`
+  BlocksPerSecond float64       `json:"blocksPerSecond"`
+  BytesPerSecond  float64       `json:"bytesPerSecond"`
+  ETA             time.Duration `json:"etaNanos"`
+  Done            bool          `json:"done"`
+}
+
+func newBlocksScannedEvent(stage string, blocks int, total int, bytes int64, start time.Time, done bool) BlocksScannedEvent {
+  e := BlocksScannedEvent{Stage: stage, Blocks: blocks, Total: total, Bytes: bytes, Done: done}
+  e.Elapsed = time.Since(start)
+  seconds := e.Elapsed.Seconds()
+  if seconds > 0 {
+    e.BlocksPerSecond = float64(blocks) / seconds
+    e.BytesPerSecond = float64(bytes) / seconds
+  }
+  if blocks > 0 && total > blocks && !done {
+    e.ETA = time.Duration(e.Elapsed.Nanoseconds() / int64(blocks) * int64(total-blocks))
+  }
+  return e
+}
+
+func (e BlocksScannedEvent) Name() string { return "blocks_scanned" }
+
+func (e BlocksScannedEvent) String() string {
+  verb := "Scanned"
+  if e.Stage == StageParse {
+    verb = "Parsed"
+  }
+  if e.Done {
+    return fmt.Sprintf("%s %d blocks, %d bytes in %s", verb, e.Blocks, e.Bytes, e.Elapsed.Round(time.Millisecond))
+  }
+  if e.Total == 0 {
+    return fmt.Sprintf("%s %d blocks, %d bytes in %s, %.1f blocks/s", verb, e.Blocks, e.Bytes, e.Elapsed.Round(time.Millisecond), e.BlocksPerSecond)
+  }
+  return fmt.Sprintf("%s %d of %d blocks (%3.2f%%), %d bytes in %s, %.1f blocks/s, ETA %s", verb, e.Blocks, e.Total, float64(e.Blocks)*100/float64(e.Total), e.Bytes, e.Elapsed.Round(time.Millisecond), e.BlocksPerSecond, e.ETA.Round(time.Second))
+}
+
+// ChainsFoundEvent is reported by FindChains. Found counts all chains,
+// Valid the ones left after dropping those with invalid headers.
+type ChainsFoundEvent struct {
+  Found      int    `json:"found"`
+  Valid      int    `json:"valid"`
+  BestHash   string `json:"bestHash,omitempty"`
+  BestHeight uint64 `json:"bestHeight"`
+}
+
+func (e ChainsFoundEvent) Name() string { return "chains_found" }
+
+func (e ChainsFoundEvent) String() string {
+  if e.Valid == 0 {
+    return fmt.Sprintf("Found %d possible chains, none valid", e.Found)
+  }
+  return fmt.Sprintf("Found %d possible chains, %d valid, best ending in %s at height %d", e.Found, e.Valid, e.BestHash, e.BestHeight)
+}
+
+// ChainDroppedEvent is reported for a chain FindChains does not return
+type ChainDroppedEvent struct {
+  Hash   string `json:"hash"`
+  Reason string `json:"reason"`
+}
+
+func (e ChainDroppedEvent) Name() string { return "chain_dropped" }
+
+func (e ChainDroppedEvent) String() string {
+  return fmt.Sprintf("Dropping chain ending in %s: %s", e.Hash, e.Reason)
+}
+
+// InvalidHeaderEvent is reported for a header failing the proof of work or
+// difficulty checks
+type InvalidHeaderEvent struct {
+  Hash   string `json:"hash"`
+  Height uint64 `json:"height"`
+  Reason string `json:"reason"`
+}
+
+func (e InvalidHeaderEvent) Name() string { return "invalid_header" }
+
+func (e InvalidHeaderEvent) String() string {
+  return fmt.Sprintf("Invalid header %s at height %d: %s", e.Hash, e.Height, e.Reason)
+}
+
+// SkippedRegionEvent is reported for every SkippedRegionError, whether or
+// not options.OnSkippedRegion is set
+type SkippedRegionEvent struct {
+  FileNumber int    `json:"fileNumber"`
+  Offset     int64  `json:"offset"`
+  Length     int64  `json:"length"`
+  Reason     string `json:"reason"`
+}
+
+func (e SkippedRegionEvent) Name() string { return "skipped_region" }
+
+func (e SkippedRegionEvent) String() string {
+  return fmt.Sprintf("Skipped %d bytes at offset %d in blk%.5d.dat: %s", e.Length, e.Offset, e.FileNumber, e.Reason)
+}
+
+// ReadErrorEvent is reported when scanning a blk file stops before its end
+// because a record could not be read, e.g. at a truncated tail
+type ReadErrorEvent struct {
+  File   string `json:"file"`
+  Offset int64  `json:"offset"`
+  Reason string `json:"reason"`
+}
+
+func (e ReadErrorEvent) Name() string { return "read_error" }
+
+func (e ReadErrorEvent) String() string {
+  return fmt.Sprintf("Stopped reading %s at offset %d: %s", e.File, e.Offset, e.Reason)
+}
+
+// DecodeFailureEvent is reported for every DecodeError. Skipped tells
+// whether options.OnDecodeError accepted it and the block was skipped.
+type DecodeFailureEvent struct {
+  Hash    string `json:"hash"`
+  File    string `json:"file"`
+  Offset  int64  `json:"offset"`
+  Field   string `json:"field"`
+  Reason  string `json:"reason"`
+  Skipped bool   `json:"skipped"`
+}
+
+func (e DecodeFailureEvent) Name() string { return "decode_failure" }
+
+func (e DecodeFailureEvent) String() string {
+  action := "failed"
+  if e.Skipped {
+    action = "skipped"
+  }
+  return fmt.Sprintf("Block %s %s, decode error in %s at offset %d, %s: %s", e.Hash, action, e.File, e.Offset, e.Field, e.Reason)
+}
+
+// MissedNotificationsEvent is reported when the sequence numbers of a ZMQ
+// topic skip messages. The blocks are then read from the index tip on.
+type MissedNotificationsEvent struct {
+  Topic    string `json:"topic"`
+  Expected uint32 `json:"expected"`
+  Sequence uint32 `json:"sequence"`
+}
+
+func (e MissedNotificationsEvent) Name() string { return "missed_notifications" }
+
+func (e MissedNotificationsEvent) String() string {
+  return fmt.Sprintf("Missed %d %s messages before sequence %d, catching up from the index tip", e.Sequence-e.Expected, e.Topic, e.Sequence)
+}
+
+// NotificationDecodeFailureEvent is reported when a block published on ZMQ
+// can not be decoded. It is then read from the index tip on like a missed one.
+type NotificationDecodeFailureEvent struct {
+  Topic    string `json:"topic"`
+  Sequence uint32 `json:"sequence"`
+  Reason   string `json:"reason"`
+}
+
+func (e NotificationDecodeFailureEvent) Name() string { return "notification_decode_failure" }
+
+func (e NotificationDecodeFailureEvent) String() string {
+  return fmt.Sprintf("Could not decode %s message %d, catching up from the index tip: %s", e.Topic, e.Sequence, e.Reason)
+}
+
+// LogProgressReporter writes every event as one line to a log.Logger
+type LogProgressReporter struct {
+  logger *log.Logger
+}
+
+// NewLogProgressReporter returns a reporter logging to logger, or to stderr
+// like the standard logger if logger is nil
+func NewLogProgressReporter(logger *log.Logger) *LogProgressReporter {
+  if logger == nil {
+    logger = log.New(os.Stderr, "", log.LstdFlags)
+  }
+  return &LogProgressReporter{logger}
+}
+
+func (r *LogProgressReporter) Report(event ProgressEvent) {
+  r.logger.Println(event.String())
+}
+
+// JSONProgressReporter writes every event as one JSON object per line:
+// {"event":<Name>,"time":<RFC 3339>,"data":<event>}. Write errors are
+// ignored, reporting progress must not stop parsing.
+type JSONProgressReporter struct {
+  mutex   sync.Mutex
+  encoder *json.Encoder
+}
+
+func NewJSONProgressReporter(w io.Writer) *JSONProgressReporter {
+  return &JSONProgressReporter{encoder: json.NewEncoder(w)}
+}
+
+type jsonProgressEvent struct {
+  Event string        `json:"event"`
+  Time  time.Time     `json:"time"`
+  Data  ProgressEvent `json:"data"`
+}
+
+func (r *JSONProgressReporter) Report(event ProgressEvent) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.encoder.Encode(jsonProgressEvent{event.Name(), time.Now(), event})
+}
+
+// report passes event to options.Progress, if set
+func (o *BitcoinBlockchainParserOptions) report(event ProgressEvent) {
+  if o.Progress != nil {
+    o.Progress.Report(event)
+  }
+}
@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/json"
+  "reflect"
+  "sort"
+  "sync"
+  "testing"
+  "time"
+)
+
+// jsonKeys returns the sorted keys of a JSON object
+func jsonKeys(t *testing.T, data []byte) []string {
+  var object map[string]json.RawMessage
+  err := json.Unmarshal(data, &object)
+  if err != nil {
+    t.Fatalf("%s: %v", data, err)
+  }
+  names := make([]string, 0, len(object))
+  for name := range object {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+func TestJSONProgressReporter(t *testing.T) {
+  // the field names are read by other programs, changing them breaks those
+  tests := []struct {
+    event  ProgressEvent
+    fields []string
+  }{
+    {FileOpenedEvent{"blk00000.dat", 1, 2}, []string{"count", "file", "number"}},
+    {HeaderCacheLoadedEvent{10, 1, 100}, []string{"blocks", "fileNumber", "filePosition"}},
+    {HeaderCacheNotSavedEvent{"reason"}, []string{"reason"}},
+    {newBlocksScannedEvent(StageScan, 1, 2, 3, time.Now(), false), []string{"blocks", "blocksPerSecond", "bytes", "bytesPerSecond", "done", "elapsedNanos", "etaNanos", "stage", "total"}},
+    {ChainsFoundEvent{2, 1, "00ff", 10}, []string{"bestHash", "bestHeight", "found", "valid"}},
+    {ChainDroppedEvent{"00ff", "reason"}, []string{"hash", "reason"}},
+    {InvalidHeaderEvent{"00ff", 10, "reason"}, []string{"hash", "height", "reason"}},
+    {SkippedRegionEvent{1, 100, 10, "reason"}, []string{"fileNumber", "length", "offset", "reason"}},
+    {ReadErrorEvent{"blk00000.dat", 100, "reason"}, []string{"file", "offset", "reason"}},
+    {DecodeFailureEvent{"00ff", "blk00000.dat", 100, "lock time", "reason", true}, []string{"field", "file", "hash", "offset", "reason", "skipped"}},
+    {MissedNotificationsEvent{"rawblock", 1, 3}, []string{"expected", "sequence", "topic"}},
+    {NotificationDecodeFailureEvent{"rawblock", 1, "reason"}, []string{"reason", "sequence", "topic"}},
+  }
+
+  var buffer bytes.Buffer
+  reporter := NewJSONProgressReporter(&buffer)
+  for _, test := range tests {
+    reporter.Report(test.event)
+  }
+
+  lines := bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n"))
+  if len(lines) != len(tests) {
+    t.Fatalf("%d lines for %d events", len(lines), len(tests))
+  }
+  for i, line := range lines {
+    if fields := jsonKeys(t, line); !reflect.DeepEqual(fields, []string{"data", "event", "time"}) {
+      t.Errorf("Line %d has fields %v", i, fields)
+    }
+    var decoded struct {
+      Event string          `json:"event"`
+      Time  string          `json:"time"`
+      Data  json.RawMessage `json:"data"`
+    }
+    err := json.Unmarshal(line, &decoded)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if decoded.Event != tests[i].event.Name() {
+      t.Errorf("Line %d is event %s, expected %s", i, decoded.Event, tests[i].event.Name())
+    }
+    _, err = time.Parse(time.RFC3339, decoded.Time)
+    if err != nil {
+      t.Errorf("Line %d: %v", i, err)
+    }
+    if fields := jsonKeys(t, decoded.Data); !reflect.DeepEqual(fields, tests[i].fields) {
+      t.Errorf("%s has fields %v, expected %v", decoded.Event, fields, tests[i].fields)
+    }
+  }
+}
+
+func TestJSONProgressReporterConcurrentLines(t *testing.T) {
+  var buffer bytes.Buffer
+  reporter := NewJSONProgressReporter(&buffer)
+  var reporters sync.WaitGroup
+  for i := 0; i < 8; i++ {
+    reporters.Add(1)
+    go func(i int) {
+      defer reporters.Done()
+      for j := 0; j < 100; j++ {
+        reporter.Report(SkippedRegionEvent{i, int64(j), 10, "reason"})
+      }
+    }(i)
+  }
+  reporters.Wait()
+
+  lines := bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n"))
+  if len(lines) != 800 {
+    t.Fatalf("%d lines", len(lines))
+  }
+  for _, line := range lines {
+    if !json.Valid(line) {
+      t.Fatalf("Invalid line %s", line)
+    }
+  }
+}
@@ -25,6 +25,7 @@
 package bitcoinBlockchainParser
 
 import (
+  "github.com/btcsuite/btcd/chaincfg"
   "github.com/btcsuite/btcd/txscript"
   "github.com/btcsuite/btcutil"
 )
@@ -36,11 +37,11 @@ type Script struct {
   Required  int
 }
 
-func NewScript(data []byte) *Script {
+func NewScript(data []byte, chainCfg *chaincfg.Params) *Script {
   s := new(Script)
   s.Data = data
 
-  class, addresses, required, err := txscript.ExtractPkScriptAddrs(s.Data, CHAINCFG)
+  class, addresses, required, err := txscript.ExtractPkScriptAddrs(s.Data, chainCfg)
   if err == nil {
     s.Addresses = addresses
     s.Required = required
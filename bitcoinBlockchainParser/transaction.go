@@ -27,20 +27,19 @@ package bitcoinBlockchainParser
 import "fmt"
 
 type Transaction struct {
-  TxId         [32]byte
-  WtxId        [32]byte
-  Version      uint32
-  Witness      bool
-  Size         int
-  BaseSize     int
-  VirtualSize  int
-  Weight       int
-  Amount       uint64
-  Fee          uint64
-  Inputs       []TxInput
-  Outputs      []TxOutput
-  WitnessItems []WitnessItem
-  Locktime     uint32
+  TxId        [32]byte
+  WtxId       [32]byte
+  Version     uint32
+  Witness     bool
+  Size        int
+  BaseSize    int
+  VirtualSize int
+  Weight      int
+  Amount      uint64
+  Fee         uint64
+  Inputs      []TxInput
+  Outputs     []TxOutput
+  Locktime    uint32
 }
 
 func (tx *Transaction) WtxIdString() string {
@@ -62,12 +61,22 @@ type TxInput struct {
   OutputIndex  uint32
   Script       []byte
   Sequence     uint32
+  Witness      []WitnessItem
+  PrevOut      *TxPrevOut
 }
 
 func (txi *TxInput) SourceTxHashString() string {
   return fmt.Sprintf("%x", txi.SourceTxHash)
 }
 
+// TxPrevOut is the output spent by an input, as read from the undo data
+type TxPrevOut struct {
+  Value    uint64
+  Script   *Script
+  Height   uint32
+  Coinbase bool
+}
+
 type TxOutput struct {
   Value  uint64
   Script *Script
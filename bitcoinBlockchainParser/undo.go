@@ -0,0 +1,439 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "fmt"
+  "github.com/btcsuite/btcd/btcec"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/pkg/errors"
+  "io"
+  "io/ioutil"
+  "path"
+)
+
+// Bitcoin Core stores scripts of these sizes in a compressed form
+const specialScriptCount = 6
+const maxScriptSize = 10000
+
+// undoRecord is one CBlockUndo record in a rev file
+type undoRecord struct {
+  position int64
+  data     []byte
+  checksum [32]byte
+  used     bool
+}
+
+// undoReader finds the undo data of blocks in rev files. If the block info
+// comes from Core's block index, the position is known. Otherwise the rev
+// file with the same number as the blk file is loaded and searched for a
+// record whose checksum matches the previous block hash. Records are written
+// in the order blocks were connected, so the search starts where the last
+// match was found.
+type undoReader struct {
+  parser     *BitcoinBlockchainParser
+  fileNumber int
+  file       blockFile
+  records    []*undoRecord
+  cursor     int
+}
+
+func newUndoReader(parser *BitcoinBlockchainParser) *undoReader {
+  u := new(undoReader)
+  u.parser = parser
+  u.fileNumber = -1
+  return u
+}
+
+func (u *undoReader) close() {
+  if u.file != nil {
+    u.file.Close()
+    u.file = nil
+  }
+  u.records = nil
+  u.fileNumber = -1
+}
+
+func (u *undoReader) fileName(fileNumber uint16) string {
+  return path.Join(u.parser.directory, fmt.Sprintf("rev%.5d.dat", fileNumber))
+}
+
+// readUndo returns the serialized CBlockUndo of the block or nil for the
+// genesis block, which has no undo data
+func (u *undoReader) readUndo(blockInfo *BlockInfo) ([]byte, error) {
+  if blockInfo.IsGenesis() {
+    return nil, nil
+  }
+
+  var prevHash [32]byte
+  copy(prevHash[:], blockInfo.PrevHash[:])
+  ReverseBytes(prevHash[:])
+
+  if blockInfo.Status&BlockHaveUndo != 0 {
+    return u.readUndoAt(blockInfo.BlkFileNumber, int64(blockInfo.BlkUndoPosition), prevHash)
+  }
+
+  err := u.loadRecords(blockInfo.BlkFileNumber)
+  if err != nil {
+    return nil, err
+  }
+
+  for i := 0; i < len(u.records); i++ {
+    index := (u.cursor + i) % len(u.records)
+    record := u.records[index]
+    if record.used {
+      continue
+    }
+    if undoChecksum(prevHash, record.data) == record.checksum {
+      record.used = true
+      u.cursor = index + 1
+      return record.data, nil
+    }
+  }
+
+  return nil, errors.Errorf("No undo data for block %x", blockInfo.Hash)
+}
+
+func (u *undoReader) readUndoAt(fileNumber uint16, position int64, prevHash [32]byte) ([]byte, error) {
+  var err error
+
+  if u.fileNumber != int(fileNumber) || u.file == nil {
+    u.close()
+    u.file, err = u.parser.openBlockFile(u.fileName(fileNumber))
+    if err != nil {
+      return nil, err
+    }
+    u.fileNumber = int(fileNumber)
+  }
+
+  _, err = u.file.Seek(position, 0)
+  if err != nil {
+    return nil, err
+  }
+
+  header := make([]byte, 8)
+  _, err = io.ReadFull(u.file, header)
+  if err != nil {
+    return nil, err
+  }
+
+  // the position comes from Core's block index, so check the record before
+  // allocating what it asks for
+  magic := binary.LittleEndian.Uint32(header[0:4])
+  if magic != uint32(u.parser.chainCfg.Net) {
+    return nil, &DecodeError{u.fileName(fileNumber), position, "magic", fmt.Sprintf("%08x is not the %s magic", magic, u.parser.chainCfg.Name)}
+  }
+  size := binary.LittleEndian.Uint32(header[4:8])
+  if size == 0 || size > maxBlockSerializedSize {
+    return nil, &DecodeError{u.fileName(fileNumber), position + 4, "undo size", fmt.Sprintf("%d exceeds maximum block size", size)}
+  }
+  data := make([]byte, int(size)+32)
+  _, err = io.ReadFull(u.file, data)
+  if err != nil {
+    return nil, err
+  }
+
+  var checksum [32]byte
+  copy(checksum[:], data[size:])
+  data = data[:size]
+
+  if undoChecksum(prevHash, data) != checksum {
+    return nil, errors.Errorf("Undo checksum mismatch in rev%.5d.dat at %d", fileNumber, position)
+  }
+  return data, nil
+}
+
+func (u *undoReader) loadRecords(fileNumber uint16) error {
+  if u.fileNumber == int(fileNumber) && u.records != nil {
+    return nil
+  }
+  u.close()
+
+  file, err := u.parser.openBlockFile(u.fileName(fileNumber))
+  if err != nil {
+    return err
+  }
+  content, err := ioutil.ReadAll(file)
+  file.Close()
+  if err != nil {
+    return err
+  }
+
+  records := make([]*undoRecord, 0)
+  position := 0
+  for position+8 <= len(content) {
+    // rev files are preallocated with zeros
+    if binary.LittleEndian.Uint32(content[position:position+4]) == 0 {
+      break
+    }
+    size := int(binary.LittleEndian.Uint32(content[position+4 : position+8]))
+    end := position + 8 + size + 32
+    if size == 0 || end > len(content) {
+      break
+    }
+
+    record := new(undoRecord)
+    record.position = int64(position)
+    record.data = content[position+8 : position+8+size]
+    copy(record.checksum[:], content[position+8+size:end])
+    records = append(records, record)
+
+    position = end
+  }
+
+  u.fileNumber = int(fileNumber)
+  u.records = records
+  u.cursor = 0
+  return nil
+}
+
+func undoChecksum(prevHash [32]byte, data []byte) [32]byte {
+  hasher := sha256.New()
+  hasher.Write(prevHash[:])
+  hasher.Write(data)
+  pass := hasher.Sum(nil)
+  return sha256.Sum256(pass)
+}
+
+// parseBlockUndo decodes a CBlockUndo into one slice of spent outputs per
+// non coinbase transaction
+func parseBlockUndo(data []byte, chainCfg *chaincfg.Params) ([][]TxPrevOut, error) {
+  txCount, offset, err := readCompactSize(data, 0)
+  if err != nil {
+    return nil, err
+  }
+  if txCount > uint64(len(data)) {
+    return nil, errors.New("Invalid undo tx count")
+  }
+
+  result := make([][]TxPrevOut, txCount)
+
+  for t := 0; t < int(txCount); t++ {
+    var prevOutCount uint64
+    prevOutCount, offset, err = readCompactSize(data, offset)
+    if err != nil {
+      return nil, err
+    }
+    if prevOutCount > uint64(len(data)-offset) {
+      return nil, errors.New("Invalid undo prevout count")
+    }
+
+    result[t] = make([]TxPrevOut, prevOutCount)
+
+    for i := 0; i < int(prevOutCount); i++ {
+      offset, err = parseCoin(data, offset, &result[t][i], chainCfg)
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  return result, nil
+}
+
+func parseCoin(data []byte, offset int, prevOut *TxPrevOut, chainCfg *chaincfg.Params) (int, error) {
+  code, offset, err := readCoreVarInt(data, offset)
+  if err != nil {
+    return offset, err
+  }
+  prevOut.Height = uint32(code >> 1)
+  prevOut.Coinbase = code&1 == 1
+
+  if prevOut.Height > 0 {
+    // legacy version field
+    _, offset, err = readCoreVarInt(data, offset)
+    if err != nil {
+      return offset, err
+    }
+  }
+
+  amount, offset, err := readCoreVarInt(data, offset)
+  if err != nil {
+    return offset, err
+  }
+  prevOut.Value = decompressAmount(amount)
+
+  scriptSize, offset, err := readCoreVarInt(data, offset)
+  if err != nil {
+    return offset, err
+  }
+
+  var script []byte
+
+  if scriptSize < specialScriptCount {
+    length := 32
+    if scriptSize < 2 {
+      length = 20
+    }
+    if offset+length > len(data) {
+      return offset, errors.New("Unexpected end of compressed script")
+    }
+    script = decompressScript(scriptSize, data[offset:offset+length])
+    offset += length
+  } else {
+    length := scriptSize - specialScriptCount
+    if length > uint64(len(data)-offset) {
+      return offset, errors.New("Unexpected end of script")
+    }
+    if length > maxScriptSize {
+      // core replaces unspendable oversized scripts by OP_RETURN
+      script = []byte{0x6a}
+    } else {
+      script = make([]byte, length)
+      copy(script, data[offset:offset+int(length)])
+    }
+    offset += int(length)
+  }
+
+  prevOut.Script = NewScript(script, chainCfg)
+  return offset, nil
+}
+
+func decompressScript(kind uint64, data []byte) []byte {
+  switch kind {
+  case 0x00:
+    // P2PKH
+    script := []byte{0x76, 0xa9, 0x14}
+    script = append(script, data...)
+    return append(script, 0x88, 0xac)
+  case 0x01:
+    // P2SH
+    script := []byte{0xa9, 0x14}
+    script = append(script, data...)
+    return append(script, 0x87)
+  case 0x02, 0x03:
+    // P2PK, compressed key
+    script := []byte{0x21, byte(kind)}
+    script = append(script, data...)
+    return append(script, 0xac)
+  case 0x04, 0x05:
+    // P2PK, uncompressed key
+    compressed := []byte{byte(kind - 2)}
+    compressed = append(compressed, data...)
+    key, err := btcec.ParsePubKey(compressed, btcec.S256())
+    if err != nil {
+      return []byte{}
+    }
+    script := []byte{0x41}
+    script = append(script, key.SerializeUncompressed()...)
+    return append(script, 0xac)
+  }
+  return []byte{}
+}
+
+func decompressAmount(x uint64) uint64 {
+  if x == 0 {
+    return 0
+  }
+  x--
+  e := x % 10
+  x /= 10
+  n := uint64(0)
+  if e < 9 {
+    d := x%9 + 1
+    x /= 9
+    n = x*10 + d
+  } else {
+    n = x + 1
+  }
+  for e > 0 {
+    n *= 10
+    e--
+  }
+  return n
+}
+
+// applyBlockUndo attaches the spent outputs to the inputs of the block and
+// calculates the fees
+func applyBlockUndo(block *Block, prevOuts [][]TxPrevOut) error {
+  if len(prevOuts) != len(block.Transactions)-1 {
+    return errors.Errorf("Undo data of block %x does not match its transactions", block.Hash)
+  }
+
+  for t := 1; t < len(block.Transactions); t++ {
+    tx := &block.Transactions[t]
+    if len(prevOuts[t-1]) != len(tx.Inputs) {
+      return errors.Errorf("Undo data of tx %x does not match its inputs", tx.TxId)
+    }
+
+    inputValue := uint64(0)
+    for i := 0; i < len(tx.Inputs); i++ {
+      tx.Inputs[i].PrevOut = &prevOuts[t-1][i]
+      inputValue += prevOuts[t-1][i].Value
+    }
+
+    if inputValue >= tx.Amount {
+      tx.Fee = inputValue - tx.Amount
+    }
+  }
+  return nil
+}
+
+func readCompactSize(data []byte, offset int) (uint64, int, error) {
+  if offset >= len(data) {
+    return 0, offset, errors.New("Unexpected end of compact size")
+  }
+  b := data[offset]
+  offset++
+
+  byteCount := 0
+  if b < 253 {
+    return uint64(b), offset, nil
+  } else if b == 253 {
+    byteCount = 2
+  } else if b == 254 {
+    byteCount = 4
+  } else {
+    byteCount = 8
+  }
+
+  if offset+byteCount > len(data) {
+    return 0, offset, errors.New("Unexpected end of compact size")
+  }
+
+  buffer := make([]byte, 8)
+  copy(buffer, data[offset:offset+byteCount])
+  return binary.LittleEndian.Uint64(buffer), offset + byteCount, nil
+}
+
+// resolvePrevOuts reads, decodes and applies the undo data of a block
+func (u *undoReader) resolvePrevOuts(blockInfo *BlockInfo, block *Block) error {
+  data, err := u.readUndo(blockInfo)
+  if err != nil || data == nil {
+    return err
+  }
+  return resolvePrevOutsFromUndo(block, data, u.parser.chainCfg)
+}
+
+func resolvePrevOutsFromUndo(block *Block, data []byte, chainCfg *chaincfg.Params) error {
+  prevOuts, err := parseBlockUndo(data, chainCfg)
+  if err != nil {
+    return err
+  }
+  return applyBlockUndo(block, prevOuts)
+}
@@ -0,0 +1,253 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/btcec"
+  "testing"
+)
+
+func TestDecompressAmount(t *testing.T) {
+  // vectors from Bitcoin Core's compress_tests
+  tests := []struct {
+    compressed uint64
+    amount     uint64
+  }{
+    {0x0, 0},
+    {0x1, 1},
+    {0x7, 1000000},
+    {0x9, 100000000},
+    {0x32, 5000000000},
+    {0x1406f40, 2100000000000000},
+  }
+  for _, test := range tests {
+    if amount := decompressAmount(test.compressed); amount != test.amount {
+      t.Errorf("decompressAmount(%x) = %d, expected %d", test.compressed, amount, test.amount)
+    }
+  }
+
+  for amount := uint64(0); amount < 100000; amount += 7 {
+    if decompressed := decompressAmount(compressAmount(amount)); decompressed != amount {
+      t.Errorf("%d round trips to %d", amount, decompressed)
+    }
+  }
+}
+
+func TestDecompressScript(t *testing.T) {
+  hash20 := bytes.Repeat([]byte{0x11}, 20)
+  _, publicKey := btcec.PrivKeyFromBytes(btcec.S256(), bytes.Repeat([]byte{0x22}, 32))
+  uncompressed := publicKey.SerializeUncompressed()
+  x := uncompressed[1:33]
+  // kinds 4 and 5 store the parity of y like 2 and 3
+  uncompressedKind := uint64(4)
+  if uncompressed[64]&1 == 1 {
+    uncompressedKind = 5
+  }
+
+  tests := []struct {
+    name     string
+    kind     uint64
+    data     []byte
+    expected []byte
+  }{
+    {"P2PKH", 0, hash20, append(append([]byte{0x76, 0xa9, 0x14}, hash20...), 0x88, 0xac)},
+    {"P2SH", 1, hash20, append(append([]byte{0xa9, 0x14}, hash20...), 0x87)},
+    {"P2PK even", 2, x, append(append([]byte{0x21, 0x02}, x...), 0xac)},
+    {"P2PK odd", 3, x, append(append([]byte{0x21, 0x03}, x...), 0xac)},
+    {"P2PK uncompressed", uncompressedKind, x, append(append([]byte{0x41}, uncompressed...), 0xac)},
+    // no point has x = 5
+    {"P2PK uncompressed invalid", 4, append(make([]byte, 31), 5), []byte{}},
+    {"unknown", 6, hash20, []byte{}},
+  }
+  for _, test := range tests {
+    script := decompressScript(test.kind, test.data)
+    if !bytes.Equal(script, test.expected) {
+      t.Errorf("%s: %x, expected %x", test.name, script, test.expected)
+    }
+  }
+
+  // the other parity decompresses to the negated point
+  other := decompressScript(9-uncompressedKind, x)
+  if len(other) != 67 || bytes.Equal(other, append(append([]byte{0x41}, uncompressed...), 0xac)) {
+    t.Errorf("Parity of kind %d ignored: %x", 9-uncompressedKind, other)
+  }
+}
+
+// testCoin serializes a Coin like Bitcoin Core's TxInUndoFormatter
+func testCoin(height uint64, coinbase bool, amount uint64, scriptKind uint64, script []byte) []byte {
+  code := height * 2
+  if coinbase {
+    code++
+  }
+  data := coreVarInt(code)
+  if height > 0 {
+    data = append(data, coreVarInt(0)...)
+  }
+  data = append(data, coreVarInt(compressAmount(amount))...)
+  data = append(data, coreVarInt(scriptKind)...)
+  return append(data, script...)
+}
+
+func TestParseCoin(t *testing.T) {
+  hash20 := bytes.Repeat([]byte{0x11}, 20)
+  opTrue := []byte{0x51}
+
+  tests := []struct {
+    name     string
+    data     []byte
+    height   uint32
+    coinbase bool
+    value    uint64
+    script   []byte
+    err      bool
+  }{
+    {"compressed", testCoin(100, true, 5000000000, 0, hash20), 100, true, 5000000000, append(append([]byte{0x76, 0xa9, 0x14}, hash20...), 0x88, 0xac), false},
+    // Core writes no version for height 0
+    {"height 0", testCoin(0, false, 1, 1, hash20), 0, false, 1, append(append([]byte{0xa9, 0x14}, hash20...), 0x87), false},
+    {"raw script", testCoin(7, false, 1000, uint64(specialScriptCount+len(opTrue)), opTrue), 7, false, 1000, opTrue, false},
+    {"oversized script", testCoin(7, false, 0, uint64(specialScriptCount+maxScriptSize+1), make([]byte, maxScriptSize+1)), 7, false, 0, []byte{0x6a}, false},
+    {"truncated compressed script", testCoin(7, false, 1000, 0, hash20[:19]), 0, false, 0, nil, true},
+    {"truncated raw script", testCoin(7, false, 1000, specialScriptCount+2, opTrue), 0, false, 0, nil, true},
+    {"huge script size", testCoin(7, false, 1000, 1<<62, opTrue), 0, false, 0, nil, true},
+    {"truncated varint", []byte{0x80}, 0, false, 0, nil, true},
+    {"empty", []byte{}, 0, false, 0, nil, true},
+  }
+  for _, test := range tests {
+    var prevOut TxPrevOut
+    offset, err := parseCoin(test.data, 0, &prevOut, testChainCfg)
+    if test.err {
+      if err == nil {
+        t.Errorf("%s: no error", test.name)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if offset != len(test.data) {
+      t.Errorf("%s: offset %d, expected %d", test.name, offset, len(test.data))
+    }
+    if prevOut.Height != test.height || prevOut.Coinbase != test.coinbase || prevOut.Value != test.value || !bytes.Equal(prevOut.Script.Data, test.script) {
+      t.Errorf("%s: %d %v %d %x", test.name, prevOut.Height, prevOut.Coinbase, prevOut.Value, prevOut.Script.Data)
+    }
+  }
+}
+
+func TestParseBlockUndo(t *testing.T) {
+  hash20 := bytes.Repeat([]byte{0x11}, 20)
+  coin1 := testCoin(1, true, 50, 0, hash20)
+  coin2 := testCoin(2, false, 40, 1, hash20)
+
+  // two transactions spending one and two outputs
+  data := []byte{2, 1}
+  data = append(data, coin1...)
+  data = append(data, 2)
+  data = append(data, coin2...)
+  data = append(data, coin1...)
+
+  prevOuts, err := parseBlockUndo(data, testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(prevOuts) != 2 || len(prevOuts[0]) != 1 || len(prevOuts[1]) != 2 {
+    t.Fatalf("Parsed %v", prevOuts)
+  }
+  if prevOuts[0][0].Value != 50 || prevOuts[1][0].Value != 40 || prevOuts[1][1].Height != 1 {
+    t.Errorf("Parsed %v", prevOuts)
+  }
+
+  hugeCount := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+  invalid := map[string][]byte{
+    "empty":               {},
+    "huge tx count":       hugeCount,
+    "huge prevout count":  append([]byte{1}, hugeCount...),
+    "truncated coin":      data[:len(data)-1],
+    "missing transaction": data[:2+len(coin1)],
+  }
+  for name, data := range invalid {
+    _, err := parseBlockUndo(data, testChainCfg)
+    if err == nil {
+      t.Errorf("%s: no error", name)
+    }
+  }
+}
+
+func TestReadUndoAt(t *testing.T) {
+  directory := t.TempDir()
+  data := append([]byte{1, 1}, testCoin(1, true, 50, 0, bytes.Repeat([]byte{0x11}, 20))...)
+  prevHash := [32]byte{1}
+  checksum := undoChecksum(prevHash, data)
+
+  record := func(magic uint32, size uint32) []byte {
+    header := make([]byte, 8)
+    binary.LittleEndian.PutUint32(header[0:4], magic)
+    binary.LittleEndian.PutUint32(header[4:8], size)
+    return append(append(header, data...), checksum[:]...)
+  }
+  valid := record(uint32(testChainCfg.Net), uint32(len(data)))
+  content := append([]byte{}, valid...)
+  content = append(content, record(0x12345678, uint32(len(data)))...)
+  content = append(content, record(uint32(testChainCfg.Net), 0xffffffff)...)
+  writeTestFile(t, directory, "rev00000.dat", nil, content)
+
+  u := newUndoReader(NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil))
+  defer u.close()
+
+  read, err := u.readUndoAt(0, 0, prevHash)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !bytes.Equal(read, data) {
+    t.Errorf("Read %x, expected %x", read, data)
+  }
+
+  _, err = u.readUndoAt(0, 0, [32]byte{2})
+  if err == nil {
+    t.Error("Checksum of another block accepted")
+  }
+
+  tests := []struct {
+    position int64
+    offset   int64
+    field    string
+  }{
+    {int64(len(valid)), int64(len(valid)), "magic"},
+    {int64(2 * len(valid)), int64(2*len(valid)) + 4, "undo size"},
+  }
+  for _, test := range tests {
+    _, err := u.readUndoAt(0, test.position, prevHash)
+    decodeError, ok := err.(*DecodeError)
+    if !ok {
+      t.Errorf("Record at %d: %v", test.position, err)
+      continue
+    }
+    if decodeError.File != u.fileName(0) || decodeError.Offset != test.offset || decodeError.Field != test.field {
+      t.Errorf("Record at %d: %v", test.position, decodeError)
+    }
+  }
+}
@@ -0,0 +1,151 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "fmt"
+)
+
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// BlockVerificationError is returned for blocks whose merkle root or
+// witness commitment does not match the decoded transactions
+type BlockVerificationError struct {
+  Hash   [32]byte
+  Reason string
+}
+
+func (e *BlockVerificationError) Error() string {
+  return fmt.Sprintf("Block %x failed verification: %s", e.Hash, e.Reason)
+}
+
+// VerifyBlock recomputes the merkle root from the txids and, if the block
+// commits to witness data, the witness merkle root from the wtxids
+func VerifyBlock(block *Block) error {
+  if len(block.Transactions) == 0 {
+    return &BlockVerificationError{block.Hash, "no transactions"}
+  }
+
+  txids := make([][32]byte, len(block.Transactions))
+  for i := 0; i < len(block.Transactions); i++ {
+    txids[i] = block.Transactions[i].TxId
+    ReverseBytes(txids[i][:])
+  }
+
+  merkleRoot, mutated := computeMerkleRoot(txids)
+  if mutated {
+    return &BlockVerificationError{block.Hash, "duplicate transactions in merkle tree"}
+  }
+  if merkleRoot != block.MerkleRoot {
+    return &BlockVerificationError{block.Hash, fmt.Sprintf("merkle root mismatch, header %x, computed %x", block.MerkleRoot, merkleRoot)}
+  }
+
+  return verifyWitnessCommitment(block)
+}
+
+func verifyWitnessCommitment(block *Block) error {
+  coinbase := &block.Transactions[0]
+
+  // the last output matching the header is the commitment
+  var commitment []byte
+  for o := len(coinbase.Outputs) - 1; o >= 0; o-- {
+    script := coinbase.Outputs[o].Script
+    if script != nil && len(script.Data) >= 38 && bytes.HasPrefix(script.Data, witnessCommitmentHeader) {
+      commitment = script.Data[6:38]
+      break
+    }
+  }
+
+  if commitment == nil {
+    for t := 0; t < len(block.Transactions); t++ {
+      if block.Transactions[t].Witness {
+        return &BlockVerificationError{block.Hash, fmt.Sprintf("unexpected witness data in tx %x", block.Transactions[t].TxId)}
+      }
+    }
+    return nil
+  }
+
+  if len(coinbase.Inputs) == 0 || len(coinbase.Inputs[0].Witness) != 1 || len(coinbase.Inputs[0].Witness[0].Data) != 32 {
+    return &BlockVerificationError{block.Hash, "invalid witness reserved value in coinbase"}
+  }
+
+  // the coinbase wtxid is defined as zero
+  wtxids := make([][32]byte, len(block.Transactions))
+  for i := 1; i < len(block.Transactions); i++ {
+    wtxids[i] = block.Transactions[i].WtxId
+    ReverseBytes(wtxids[i][:])
+  }
+
+  witnessRoot, _ := computeMerkleRoot(wtxids)
+
+  data := make([]byte, 64)
+  copy(data[0:32], witnessRoot[:])
+  copy(data[32:64], coinbase.Inputs[0].Witness[0].Data)
+  pass := sha256.Sum256(data)
+  pass = sha256.Sum256(pass[:])
+
+  if !bytes.Equal(pass[:], commitment) {
+    return &BlockVerificationError{block.Hash, fmt.Sprintf("witness commitment mismatch, coinbase %x, computed %x", commitment, pass)}
+  }
+  return nil
+}
+
+// computeMerkleRoot works on hashes in internal byte order. Like Bitcoin
+// Core it reports a tree as mutated if two identical hashes are paired, which
+// lets a block with duplicated transactions have the same root.
+func computeMerkleRoot(hashes [][32]byte) ([32]byte, bool) {
+  mutated := false
+  level := make([][32]byte, len(hashes))
+  copy(level, hashes)
+
+  data := make([]byte, 64)
+  for len(level) > 1 {
+    for i := 0; i+1 < len(level); i += 2 {
+      if level[i] == level[i+1] {
+        mutated = true
+      }
+    }
+    if len(level)%2 == 1 {
+      level = append(level, level[len(level)-1])
+    }
+
+    next := make([][32]byte, len(level)/2)
+    for i := 0; i < len(next); i++ {
+      copy(data[0:32], level[2*i][:])
+      copy(data[32:64], level[2*i+1][:])
+      pass := sha256.Sum256(data)
+      next[i] = sha256.Sum256(pass[:])
+    }
+    level = next
+  }
+
+  if len(level) == 0 {
+    return [32]byte{}, mutated
+  }
+  return level[0], mutated
+}
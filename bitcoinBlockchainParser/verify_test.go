@@ -0,0 +1,151 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "github.com/btcsuite/btcutil"
+  "strings"
+  "testing"
+)
+
+// newTestSpend returns a transaction spending a made up output, with
+// witness data if witness is not nil
+func newTestSpend(tag byte, witness wire.TxWitness) *wire.MsgTx {
+  tx := wire.NewMsgTx(2)
+  prevHash := chainhash.Hash{tag}
+  input := wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, witness)
+  if witness == nil {
+    input.SignatureScript = []byte{0x51}
+  }
+  tx.AddTxIn(input)
+  tx.AddTxOut(wire.NewTxOut(1000, []byte{0x00, 0x14, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag, tag}))
+  return tx
+}
+
+// newVerifyTestBlock returns a block of txs whose header commits to the
+// merkle root of rootTxs, or of txs if rootTxs is nil
+func newVerifyTestBlock(t *testing.T, txs []*wire.MsgTx, rootTxs []*wire.MsgTx) *Block {
+  if rootTxs == nil {
+    rootTxs = txs
+  }
+  utilTxs := make([]*btcutil.Tx, 0, len(rootTxs))
+  for _, tx := range rootTxs {
+    utilTxs = append(utilTxs, btcutil.NewTx(tx))
+  }
+  merkles := blockchain.BuildMerkleTreeStore(utilTxs, false)
+
+  block := wire.NewMsgBlock(wire.NewBlockHeader(1, &chainhash.Hash{}, merkles[len(merkles)-1], testChainCfg.PowLimitBits, 0))
+  for _, tx := range txs {
+    block.AddTransaction(tx)
+  }
+
+  var buffer bytes.Buffer
+  err := block.Serialize(&buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+  decoded, err := DecodeBlock(&buffer, testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return decoded
+}
+
+// addWitnessCommitment adds the commitment to the wtxids of txs and the
+// witness reserved value to the coinbase. tamper changes the commitment.
+func addWitnessCommitment(txs []*wire.MsgTx, tamper bool) {
+  reserved := make([]byte, 32)
+  txs[0].TxIn[0].Witness = wire.TxWitness{reserved}
+
+  utilTxs := make([]*btcutil.Tx, 0, len(txs))
+  for _, tx := range txs {
+    utilTxs = append(utilTxs, btcutil.NewTx(tx))
+  }
+  merkles := blockchain.BuildMerkleTreeStore(utilTxs, true)
+  witnessRoot := merkles[len(merkles)-1]
+
+  commitment := sha256.Sum256(append(witnessRoot[:], reserved...))
+  commitment = sha256.Sum256(commitment[:])
+  if tamper {
+    commitment[0] ^= 1
+  }
+  txs[0].AddTxOut(wire.NewTxOut(0, append(append([]byte{}, witnessCommitmentHeader...), commitment[:]...)))
+}
+
+func TestVerifyBlock(t *testing.T) {
+  legacy := func() []*wire.MsgTx {
+    return []*wire.MsgTx{newTestCoinbase(1, 50, []byte{0x51}), newTestSpend(1, nil), newTestSpend(2, nil)}
+  }
+  segwit := func() []*wire.MsgTx {
+    return []*wire.MsgTx{newTestCoinbase(1, 50, []byte{0x51}), newTestSpend(1, nil), newTestSpend(2, wire.TxWitness{{0x30, 0x01}, {0x02, 0x03}})}
+  }
+
+  valid := legacy()
+  // CVE-2012-2459: repeating the last transaction keeps the merkle root
+  duplicated := append(legacy(), valid[2])
+
+  committed := segwit()
+  addWitnessCommitment(committed, false)
+  tampered := segwit()
+  addWitnessCommitment(tampered, true)
+  noReserved := segwit()
+  addWitnessCommitment(noReserved, false)
+  noReserved[0].TxIn[0].Witness = wire.TxWitness{{0x01}}
+
+  wrongRoot := newVerifyTestBlock(t, legacy(), nil)
+  wrongRoot.MerkleRoot[0] ^= 1
+
+  tests := []struct {
+    name   string
+    block  *Block
+    reason string
+  }{
+    {"legacy", newVerifyTestBlock(t, valid, nil), ""},
+    {"segwit", newVerifyTestBlock(t, committed, nil), ""},
+    {"wrong merkle root", wrongRoot, "merkle root mismatch"},
+    {"duplicated transaction", newVerifyTestBlock(t, duplicated, valid), "duplicate transactions"},
+    {"witness without commitment", newVerifyTestBlock(t, segwit(), nil), "unexpected witness data"},
+    {"wrong witness commitment", newVerifyTestBlock(t, tampered, nil), "witness commitment mismatch"},
+    {"wrong witness reserved value", newVerifyTestBlock(t, noReserved, nil), "invalid witness reserved value"},
+  }
+  for _, test := range tests {
+    err := VerifyBlock(test.block)
+    if test.reason == "" {
+      if err != nil {
+        t.Errorf("%s: %v", test.name, err)
+      }
+      continue
+    }
+    verificationError, ok := err.(*BlockVerificationError)
+    if !ok || verificationError.Hash != test.block.Hash || !strings.Contains(verificationError.Reason, test.reason) {
+      t.Errorf("%s: %v, expected %s", test.name, err, test.reason)
+    }
+  }
+}
@@ -0,0 +1,80 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "github.com/pkg/errors"
+  "io/ioutil"
+  "os"
+  "time"
+)
+
+// WatchBlkFiles calls onChange whenever bitcoind wrote to the blk files,
+// checked every interval until stop is closed
+func (bc *BitcoinBlockchainParser) WatchBlkFiles(interval time.Duration, onChange func() error, stop <-chan struct{}) error {
+  last, err := bc.lastBlockFile()
+  if err != nil {
+    return err
+  }
+
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-stop:
+      return nil
+    case <-ticker.C:
+    }
+
+    current, err := bc.lastBlockFile()
+    if err != nil {
+      return err
+    }
+    if current.Name() == last.Name() && current.Size() == last.Size() && current.ModTime().Equal(last.ModTime()) {
+      continue
+    }
+    last = current
+
+    err = onChange()
+    if err != nil {
+      return err
+    }
+  }
+}
+
+// lastBlockFile returns the newest blk file. Files are preallocated, so
+// besides the size its modification time tells whether blocks were added.
+func (bc *BitcoinBlockchainParser) lastBlockFile() (os.FileInfo, error) {
+  fileInfos, err := ioutil.ReadDir(bc.directory)
+  if err != nil {
+    return nil, err
+  }
+  fileInfos = filterBlockDataFiles(fileInfos)
+  if len(fileInfos) == 0 {
+    return nil, errors.Errorf("No blk files in %s", bc.directory)
+  }
+  return fileInfos[len(fileInfos)-1], nil
+}
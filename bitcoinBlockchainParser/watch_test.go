@@ -0,0 +1,132 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "os"
+  "path"
+  "testing"
+  "time"
+)
+
+func TestWatchBlkFilesReportsAppendedBlocks(t *testing.T) {
+  directory := t.TempDir()
+  block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, []byte{0x51}))
+  block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 50, []byte{0x51}))
+  block3 := newTestBlock(t, block2.BlockHash(), 1500001200, newTestCoinbase(3, 50, []byte{0x51}))
+  // a longer branch replacing block 3
+  branch3 := newTestBlock(t, block2.BlockHash(), 1500001200, newTestCoinbase(13, 50, []byte{0x51}))
+  branch4 := newTestBlock(t, branch3.BlockHash(), 1500001800, newTestCoinbase(14, 50, []byte{0x51}))
+
+  blkData := append(testRecord(t, block1), testRecord(t, block2)...)
+  writeTestFile(t, directory, "blk00000.dat", nil, blkData)
+
+  options := newTestParserOptions()
+  options.FollowInterval = 10 * time.Millisecond
+  source := NewBlkFileSource(directory, testChainCfg, options)
+  defer source.Close()
+
+  chains, err := source.Headers(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tip := chains[0].Last
+  if tip.Hash != testHash(block2) {
+    t.Fatalf("Tip %x", tip.Hash)
+  }
+
+  // like Follow, look for chains after the tip on every change
+  found := make(chan []*Chain)
+  stop := make(chan struct{})
+  done := make(chan error)
+  go func() {
+    done <- source.WatchTips(func() error {
+      chains, err := source.Headers(tip)
+      if err != nil {
+        return err
+      }
+      found <- chains
+      return nil
+    }, stop)
+  }()
+
+  // like bitcoind, append in one write, a rewrite could be seen half done
+  appendBlocks := func(blocks ...*wire.MsgBlock) []*Chain {
+    records := make([]byte, 0)
+    for _, block := range blocks {
+      records = append(records, testRecord(t, block)...)
+    }
+    file, err := os.OpenFile(path.Join(directory, "blk00000.dat"), os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+      t.Fatal(err)
+    }
+    _, err = file.Write(records)
+    file.Close()
+    if err != nil {
+      t.Fatal(err)
+    }
+    select {
+    case chains := <-found:
+      return chains
+    case err := <-done:
+      t.Fatalf("Stopped watching: %v", err)
+    case <-time.After(5 * time.Second):
+      t.Fatal("No new tip")
+    }
+    return nil
+  }
+
+  // changes are noticed relative to the files when watching started
+  time.Sleep(5 * options.FollowInterval)
+  chains = appendBlocks(block3)
+  if len(chains) == 0 || chains[0].First.Hash != testHash(block2) || chains[0].Last.Hash != testHash(block3) {
+    t.Fatalf("Found %v", chains)
+  }
+  tip = chains[0].Last
+
+  // nothing changed, nothing reported
+  select {
+  case chains := <-found:
+    t.Fatalf("Found %v without a change", chains)
+  case <-time.After(5 * options.FollowInterval):
+  }
+
+  // the best chain no longer starts at the tip but at its sibling
+  chains = appendBlocks(branch3, branch4)
+  if len(chains) == 0 || chains[0].First.Hash != testHash(branch3) || chains[0].Last.Hash != testHash(branch4) {
+    t.Fatalf("Found %v", chains)
+  }
+  if chains[0].First.PrevHash != tip.PrevHash {
+    t.Errorf("Branch forks off at %x, expected %x", chains[0].First.PrevHash, tip.PrevHash)
+  }
+
+  close(stop)
+  err = <-done
+  if err != nil {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,150 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+const annexTag = 0x50
+
+const witnessVersionNone = -1
+const witnessVersionUnknown = -2
+
+// spentWitnessProgram returns version and program of the witness output
+// spent by this input. The spent script comes from the undo data if prevouts
+// were resolved, a P2SH wrapped program is taken from the input script.
+// Native segwit inputs without resolved prevout give witnessVersionUnknown.
+func (txi *TxInput) spentWitnessProgram() (int, []byte) {
+  if len(txi.Script) > 0 {
+    // P2SH wrapped: the input script is a single push of the program
+    if int(txi.Script[0]) == len(txi.Script)-1 {
+      version, program := parseWitnessProgram(txi.Script[1:])
+      if version != witnessVersionNone {
+        return version, program
+      }
+    }
+    return witnessVersionNone, nil
+  }
+
+  if txi.PrevOut != nil && txi.PrevOut.Script != nil {
+    return parseWitnessProgram(txi.PrevOut.Script.Data)
+  }
+
+  if len(txi.Witness) == 0 {
+    return witnessVersionNone, nil
+  }
+  return witnessVersionUnknown, nil
+}
+
+func parseWitnessProgram(script []byte) (int, []byte) {
+  if len(script) < 4 || len(script) > 42 || int(script[1]) != len(script)-2 {
+    return witnessVersionNone, nil
+  }
+  if script[0] == 0x00 {
+    return 0, script[2:]
+  }
+  if script[0] >= 0x51 && script[0] <= 0x60 {
+    return int(script[0]-0x50), script[2:]
+  }
+  return witnessVersionNone, nil
+}
+
+func isControlBlock(data []byte) bool {
+  return len(data) >= 33 && (len(data)-33)%32 == 0 && len(data) <= 33+128*32 && data[0]&0xfe == 0xc0
+}
+
+// Annex returns the taproot annex of the witness or nil. If the spent output
+// is not known, a last item starting with 0x50 is taken as annex.
+func (txi *TxInput) Annex() []byte {
+  if len(txi.Witness) < 2 {
+    return nil
+  }
+  version, _ := txi.spentWitnessProgram()
+  if version != 1 && version != witnessVersionUnknown {
+    return nil
+  }
+  last := txi.Witness[len(txi.Witness)-1].Data
+  if len(last) > 0 && last[0] == annexTag {
+    return last
+  }
+  return nil
+}
+
+func (txi *TxInput) HasAnnex() bool {
+  return txi.Annex() != nil
+}
+
+// witnessStack returns the witness items without annex
+func (txi *TxInput) witnessStack() []WitnessItem {
+  if txi.HasAnnex() {
+    return txi.Witness[0 : len(txi.Witness)-1]
+  }
+  return txi.Witness
+}
+
+// WitnessScript returns the executed script of a P2WSH or taproot script
+// path spend and nil for key spends
+func (txi *TxInput) WitnessScript() []byte {
+  stack := txi.witnessStack()
+  if len(stack) == 0 {
+    return nil
+  }
+
+  version, program := txi.spentWitnessProgram()
+  switch version {
+  case 0:
+    if len(program) == 32 {
+      return stack[len(stack)-1].Data
+    }
+  case 1:
+    if len(stack) >= 2 {
+      return stack[len(stack)-2].Data
+    }
+  case witnessVersionUnknown:
+    if len(stack) >= 2 && isControlBlock(stack[len(stack)-1].Data) {
+      return stack[len(stack)-2].Data
+    }
+    // a P2WPKH witness is signature and compressed public key
+    if len(stack) == 2 && len(stack[1].Data) == 33 {
+      return nil
+    }
+    if len(stack) >= 2 {
+      return stack[len(stack)-1].Data
+    }
+  }
+  return nil
+}
+
+// ControlBlock returns the control block of a taproot script path spend
+func (txi *TxInput) ControlBlock() []byte {
+  stack := txi.witnessStack()
+  if len(stack) < 2 {
+    return nil
+  }
+  version, _ := txi.spentWitnessProgram()
+  last := stack[len(stack)-1].Data
+  if (version == 1 || version == witnessVersionUnknown) && isControlBlock(last) {
+    return last
+  }
+  return nil
+}
@@ -0,0 +1,130 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "testing"
+)
+
+func TestWitnessStoredPerInput(t *testing.T) {
+  tx := wire.NewMsgTx(2)
+  witnesses := []wire.TxWitness{
+    {{0x30, 0x01}, {0x02, 0x03}},
+    nil,
+    {{}, bytes.Repeat([]byte{0x52}, 300)},
+  }
+  for i, witness := range witnesses {
+    prevHash := chainhash.Hash{byte(i)}
+    tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, 0), nil, witness))
+  }
+  tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+
+  var buffer bytes.Buffer
+  err := tx.Serialize(&buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data := buffer.Bytes()
+  decoded, err := DecodeTransaction(data, testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  for i, witness := range witnesses {
+    items := decoded.Inputs[i].Witness
+    if len(items) != len(witness) {
+      t.Fatalf("Input %d has %d witness items, expected %d", i, len(items), len(witness))
+    }
+    for w, item := range items {
+      if !bytes.Equal(item.Data, witness[w]) {
+        t.Errorf("Input %d witness item %d is %x, expected %x", i, w, item.Data, witness[w])
+      }
+      if !bytes.Equal(data[item.BlkFilePosition:item.BlkFilePosition+len(item.Data)], witness[w]) {
+        t.Errorf("Input %d witness item %d position %d does not point at its data", i, w, item.BlkFilePosition)
+      }
+    }
+  }
+}
+
+func TestWitnessHeuristics(t *testing.T) {
+  items := func(data ...[]byte) []WitnessItem {
+    witness := make([]WitnessItem, len(data))
+    for i := range data {
+      witness[i].Data = data[i]
+    }
+    return witness
+  }
+  spent := func(script []byte) *TxPrevOut {
+    return &TxPrevOut{Script: &Script{Data: script}}
+  }
+  signature := bytes.Repeat([]byte{0x30}, 71)
+  schnorr := bytes.Repeat([]byte{0x01}, 64)
+  publicKey := append([]byte{0x02}, bytes.Repeat([]byte{0x03}, 32)...)
+  script := []byte{0x52, 0x21, 0xae}
+  control := append([]byte{0xc0}, bytes.Repeat([]byte{0x04}, 32)...)
+  longControl := append([]byte{0xc1}, bytes.Repeat([]byte{0x05}, 64)...)
+  annex := []byte{annexTag, 0xab}
+  p2wpkh := append([]byte{0x00, 0x14}, bytes.Repeat([]byte{0x06}, 20)...)
+  p2wsh := append([]byte{0x00, 0x20}, bytes.Repeat([]byte{0x07}, 32)...)
+  p2tr := append([]byte{0x51, 0x20}, bytes.Repeat([]byte{0x08}, 32)...)
+
+  tests := []struct {
+    name    string
+    input   TxInput
+    script  []byte
+    control []byte
+    annex   []byte
+  }{
+    {"legacy", TxInput{Script: []byte{0x51}}, nil, nil, nil},
+    {"P2WPKH", TxInput{Witness: items(signature, publicKey), PrevOut: spent(p2wpkh)}, nil, nil, nil},
+    {"P2WPKH unknown prevout", TxInput{Witness: items(signature, publicKey)}, nil, nil, nil},
+    {"P2WSH", TxInput{Witness: items(nil, signature, script), PrevOut: spent(p2wsh)}, script, nil, nil},
+    {"P2WSH unknown prevout", TxInput{Witness: items(nil, signature, script)}, script, nil, nil},
+    {"P2SH-P2WSH", TxInput{Script: append([]byte{byte(len(p2wsh))}, p2wsh...), Witness: items(signature, script)}, script, nil, nil},
+    // 0x50 is not an annex before taproot
+    {"P2WSH script starting with 0x50", TxInput{Witness: items(signature, annex), PrevOut: spent(p2wsh)}, annex, nil, nil},
+    {"taproot key path", TxInput{Witness: items(schnorr), PrevOut: spent(p2tr)}, nil, nil, nil},
+    {"taproot key path unknown prevout", TxInput{Witness: items(schnorr)}, nil, nil, nil},
+    {"taproot key path with annex", TxInput{Witness: items(schnorr, annex), PrevOut: spent(p2tr)}, nil, nil, annex},
+    {"taproot script path", TxInput{Witness: items(schnorr, script, control), PrevOut: spent(p2tr)}, script, control, nil},
+    {"taproot script path unknown prevout", TxInput{Witness: items(schnorr, script, longControl)}, script, longControl, nil},
+    {"taproot script path with annex", TxInput{Witness: items(schnorr, script, longControl, annex), PrevOut: spent(p2tr)}, script, longControl, annex},
+    {"taproot script path with annex unknown prevout", TxInput{Witness: items(schnorr, script, control, annex)}, script, control, annex},
+  }
+  for _, test := range tests {
+    if annex := test.input.Annex(); !bytes.Equal(annex, test.annex) || test.input.HasAnnex() != (test.annex != nil) {
+      t.Errorf("%s: annex %x, expected %x", test.name, annex, test.annex)
+    }
+    if script := test.input.WitnessScript(); !bytes.Equal(script, test.script) {
+      t.Errorf("%s: witness script %x, expected %x", test.name, script, test.script)
+    }
+    if control := test.input.ControlBlock(); !bytes.Equal(control, test.control) {
+      t.Errorf("%s: control block %x, expected %x", test.name, control, test.control)
+    }
+  }
+}
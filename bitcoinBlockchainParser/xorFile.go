@@ -0,0 +1,105 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package bitcoinBlockchainParser
+
+import (
+  "io"
+  "io/ioutil"
+  "os"
+  "path"
+)
+
+// blockFile is what the parser needs from an opened blk or rev file
+type blockFile interface {
+  io.Reader
+  io.Seeker
+  io.Closer
+}
+
+// xorFile de-obfuscates blk and rev files written by Bitcoin Core with the
+// key from blocks/xor.dat. The key is applied relative to the absolute
+// offset in the file, so reads after any seek decode correctly.
+type xorFile struct {
+  file   *os.File
+  key    []byte
+  offset int64
+}
+
+func (f *xorFile) Read(p []byte) (int, error) {
+  n, err := f.file.Read(p)
+  keyLength := int64(len(f.key))
+  for i := 0; i < n; i++ {
+    p[i] ^= f.key[(f.offset+int64(i))%keyLength]
+  }
+  f.offset += int64(n)
+  return n, err
+}
+
+func (f *xorFile) Seek(offset int64, whence int) (int64, error) {
+  position, err := f.file.Seek(offset, whence)
+  if err != nil {
+    return position, err
+  }
+  f.offset = position
+  return position, nil
+}
+
+func (f *xorFile) Close() error {
+  return f.file.Close()
+}
+
+// loadXorKey reads blocks/xor.dat if present. A missing file or an all zero
+// key means the block files are not obfuscated.
+func (bc *BitcoinBlockchainParser) loadXorKey() error {
+  key, err := ioutil.ReadFile(path.Join(bc.directory, "xor.dat"))
+  if os.IsNotExist(err) {
+    bc.xorKey = nil
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  bc.xorKey = nil
+  for i := 0; i < len(key); i++ {
+    if key[i] != 0x00 {
+      bc.xorKey = key
+      break
+    }
+  }
+  return nil
+}
+
+func (bc *BitcoinBlockchainParser) openBlockFile(fileName string) (blockFile, error) {
+  file, err := os.Open(fileName)
+  if err != nil {
+    return nil, err
+  }
+  if bc.xorKey == nil {
+    return file, nil
+  }
+  return &xorFile{file, bc.xorKey, 0}, nil
+}
@@ -0,0 +1,158 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package bitcoinBlockchainParser
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "io"
+  "path"
+  "testing"
+)
+
+var testXorKey = []byte{0x5a, 0x01, 0xc3, 0x77, 0x00, 0xe8, 0x31, 0x9f}
+
+// compressAmount is Bitcoin Core's CompressAmount
+func compressAmount(n uint64) uint64 {
+  if n == 0 {
+    return 0
+  }
+  e := uint64(0)
+  for n%10 == 0 && e < 9 {
+    n /= 10
+    e++
+  }
+  if e < 9 {
+    d := n % 10
+    n /= 10
+    return 1 + (n*9+d-1)*10 + e
+  }
+  return 1 + (n-1)*10 + 9
+}
+
+// testUndoRecord returns the rev file record of a block whose only spending
+// transaction spends the P2PKH coinbase output of prev at height
+func testUndoRecord(prev *wire.MsgBlock, height uint64, value uint64, pubKeyHash []byte) []byte {
+  data := []byte{1, 1}
+  data = append(data, coreVarInt(height*2+1)...)
+  data = append(data, coreVarInt(0)...)
+  data = append(data, coreVarInt(compressAmount(value))...)
+  data = append(data, coreVarInt(0)...)
+  data = append(data, pubKeyHash...)
+
+  var prevHash [32]byte
+  blockHash := prev.BlockHash()
+  copy(prevHash[:], blockHash[:])
+  checksum := undoChecksum(prevHash, data)
+
+  record := make([]byte, 8, 8+len(data)+32)
+  binary.LittleEndian.PutUint32(record[0:4], uint32(testChainCfg.Net))
+  binary.LittleEndian.PutUint32(record[4:8], uint32(len(data)))
+  record = append(record, data...)
+  return append(record, checksum[:]...)
+}
+
+func TestObfuscatedBlockFilesRoundTrip(t *testing.T) {
+  pubKeyHash := bytes.Repeat([]byte{0x42}, 20)
+  pkScript := append(append([]byte{0x76, 0xa9, 0x14}, pubKeyHash...), 0x88, 0xac)
+
+  block1 := newTestBlock(t, chainhash.Hash{}, 1500000000, newTestCoinbase(1, 50, pkScript))
+  spend := wire.NewMsgTx(1)
+  coinbaseHash := block1.Transactions[0].TxHash()
+  spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&coinbaseHash, 0), []byte{0x51}, nil))
+  spend.AddTxOut(wire.NewTxOut(40, []byte{0x51}))
+  block2 := newTestBlock(t, block1.BlockHash(), 1500000600, newTestCoinbase(2, 60, []byte{0x51}), spend)
+
+  blkData := append(testRecord(t, block1), testRecord(t, block2)...)
+  directory := t.TempDir()
+  writeTestFile(t, directory, "xor.dat", nil, testXorKey)
+  writeTestFile(t, directory, "blk00000.dat", testXorKey, blkData)
+  writeTestFile(t, directory, "rev00000.dat", testXorKey, testUndoRecord(block1, 1, 50, pubKeyHash))
+
+  bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, nil)
+  err := bc.loadXorKey()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // reads after a seek decode relative to the file start
+  file, err := bc.openBlockFile(path.Join(directory, "blk00000.dat"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer file.Close()
+  for _, offset := range []int64{0, 3, int64(len(blkData)) - 13} {
+    _, err = file.Seek(offset, io.SeekStart)
+    if err != nil {
+      t.Fatal(err)
+    }
+    data := make([]byte, 13)
+    _, err = io.ReadFull(file, data)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if !bytes.Equal(data, blkData[offset:offset+13]) {
+      t.Fatalf("read %x at %d, expected %x", data, offset, blkData[offset:offset+13])
+    }
+  }
+
+  for _, workers := range []int{1, 2} {
+    var parsed []*Block
+    bc := NewBitcoinBlockchainParser(directory, testChainCfg, nil, func(number int, count int, block *Block) error {
+      parsed = append(parsed, block)
+      return nil
+    })
+    options := newTestParserOptions()
+    options.ResolvePrevOuts = true
+    options.DecodeWorkers = workers
+
+    blockMap, blockOrder, err := bc.CollectBlockInfo(options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    chains, err := bc.FindChains(blockMap, blockOrder, options)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = bc.ParseBlocks(chains[0], options)
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    if len(parsed) != 2 || parsed[1].Hash != testHash(block2) {
+      t.Fatalf("%d workers parsed %d blocks", workers, len(parsed))
+    }
+    tx := parsed[1].Transactions[1]
+    prevOut := tx.Inputs[0].PrevOut
+    if prevOut == nil || prevOut.Value != 50 || prevOut.Height != 1 || !prevOut.Coinbase || !bytes.Equal(prevOut.Script.Data, pkScript) {
+      t.Fatalf("%d workers resolved %+v", workers, prevOut)
+    }
+    if tx.Fee != 10 {
+      t.Fatalf("%d workers calculated fee %d", workers, tx.Fee)
+    }
+  }
+}
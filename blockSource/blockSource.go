@@ -0,0 +1,264 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package blockSource
+
+import (
+  "github.com/pkg/errors"
+  "log"
+  "omnom/bitcoinBlockchainParser"
+  "omnom/indexer"
+  "time"
+)
+
+// ErrInterrupted is returned by Sync if it was stopped before the whole
+// chain was indexed
+var ErrInterrupted = errors.New("Interrupted")
+
+// checkpointInterval is how often the progress of a long sync is made
+// durable, so a crash does not lose it
+const checkpointInterval = time.Minute
+
+// IndexTip returns the tip of an existing index with its height, the
+// start for Sync
+func IndexTip(idx indexer.Indexer) (*bitcoinBlockchainParser.BlockInfo, error) {
+  tip, err := idx.GetTipBlockInfo()
+  if err != nil {
+    return nil, err
+  }
+  if tip == nil {
+    return nil, errors.New("Index has no tip")
+  }
+  tip.Height = idx.GetBlockCount() - 1
+  return tip, nil
+}
+
+// Sync passes all blocks of the best chain of source after start to idx,
+// or the whole chain if start is nil, and returns the new tip. If start is
+// not part of the best chain of source any more, the indexed chain is
+// walked back up to the reorg cache size of idx to find a block which is,
+// and the blocks after it are undone with OnRewind first.
+//
+// If stop is closed, Sync finishes the current block, checkpoints idx and
+// returns the last indexed block with ErrInterrupted. A block skipped by
+// source fails Sync after the blocks before it were checkpointed.
+func Sync(source BlockSource, idx indexer.Indexer, start *bitcoinBlockchainParser.BlockInfo, stop <-chan struct{}) (*bitcoinBlockchainParser.BlockInfo, error) {
+  if start == nil {
+    log.Println("Starting to build index")
+  } else {
+    log.Println("Checking index consistency...")
+  }
+
+  chain, orphaned, err := findChain(source, idx, start)
+  if err != nil {
+    return nil, err
+  }
+
+  for i := 0; i < len(orphaned); i++ {
+    log.Printf("Rewinding block %x at height %d\n", orphaned[i].Hash, orphaned[i].Height)
+    err = idx.OnRewind(int(orphaned[i].Height), orphaned[i])
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if start != nil {
+    if chain.First == chain.Last {
+      log.Println("No new blocks found")
+      return chain.Last, nil
+    }
+    log.Printf("Last tip:    %x\n", chain.First.Hash)
+    log.Printf("Chain last:  %x\n", chain.Last.Hash)
+    log.Printf("Total len:   %d\n", chain.Last.Height+1)
+  }
+
+  // the first block of the chain is start, which is indexed already
+  last, err := indexChain(source, idx, chain, start != nil, stop)
+  if err == ErrInterrupted {
+    return last, err
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  err = idx.CleanupReorgCache(chain)
+  if err != nil {
+    return nil, err
+  }
+  return chain.Last, nil
+}
+
+// Follow keeps idx up to date with source until stop is closed. tip is the
+// last indexed block as returned by Sync.
+func Follow(source BlockSource, idx indexer.Indexer, tip *bitcoinBlockchainParser.BlockInfo, stop <-chan struct{}) error {
+  if tip == nil {
+    return errors.New("No chain tip to follow")
+  }
+
+  log.Printf("Following new blocks after %x\n", tip.Hash)
+  err := source.WatchTips(func() error {
+    newTip, err := Sync(source, idx, tip, stop)
+    if err != nil {
+      return err
+    }
+    // keep the tip only, not the chain behind it
+    newTip.PrevBlockInfo = nil
+    tip = newTip
+    return nil
+  }, stop)
+  if err == ErrInterrupted {
+    return nil
+  }
+  return err
+}
+
+// findChain returns the best chain of source starting at start, or at the
+// indexed block before start where it forks off the indexed chain. The
+// indexed blocks after the fork point are returned too, tip first.
+func findChain(source BlockSource, idx indexer.Indexer, start *bitcoinBlockchainParser.BlockInfo) (*bitcoinBlockchainParser.Chain, []*bitcoinBlockchainParser.BlockInfo, error) {
+  orphaned := make([]*bitcoinBlockchainParser.BlockInfo, 0)
+  for i := 0; ; i++ {
+    chains, err := source.Headers(start)
+    if err != nil {
+      return nil, nil, err
+    }
+    if len(chains) > 0 && (start == nil || chains[0].First.Hash == start.Hash) {
+      return chains[0], orphaned, nil
+    }
+    if start == nil {
+      return nil, nil, errors.New("No chain found")
+    }
+    if i >= idx.GetReorgCacheSize() {
+      return nil, nil, errors.Errorf("None of the last %d indexed blocks is part of the chain", i+1)
+    }
+
+    // Reorg: the indexed tip is gone, or a branch forking off before it
+    // has more work. Walk back the indexed chain until the best chain
+    // starts at an indexed block.
+    prev, err := idx.IndexSearch().FindBlockInfoByBlockHash(start.PrevHash[0:32])
+    if err != nil {
+      return nil, nil, err
+    }
+    if prev == nil {
+      return nil, nil, errors.Errorf("Block %x is not indexed", start.PrevHash)
+    }
+    log.Printf("Block %x is not part of the chain any more, trying %x\n", start.Hash, prev.Hash)
+    orphaned = append(orphaned, start)
+    prev.Height = start.Height - 1
+    start = prev
+  }
+}
+
+// indexChain passes the blocks of chain to idx in chain order, with
+// absolute heights and the height of the chain's tip as total. It returns
+// the last indexed block, which is checkpointed.
+func indexChain(source BlockSource, idx indexer.Indexer, chain *bitcoinBlockchainParser.Chain, skipFirst bool, stop <-chan struct{}) (*bitcoinBlockchainParser.BlockInfo, error) {
+  var last *bitcoinBlockchainParser.BlockInfo
+  blockInfo := chain.First
+  if skipFirst {
+    last = blockInfo
+    blockInfo = blockInfo.NextBlockInfo
+  }
+
+  total := int(chain.Last.Height) + 1
+  blockCount := 0
+  start := time.Now()
+  lastCheckpoint := start
+
+  for ; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    select {
+    case <-stop:
+      if last != nil {
+        log.Printf("Interrupted after %d blocks, resuming after %x next time\n", blockCount, last.Hash)
+      }
+      err := checkpoint(idx, last)
+      if err != nil {
+        return nil, err
+      }
+      return last, ErrInterrupted
+    default:
+    }
+
+    height := int(blockInfo.Height)
+
+    // fetch the block first, sources without blk files learn the size of
+    // a block only from the block itself
+    var block *bitcoinBlockchainParser.Block
+    if idx.ShouldParseBlockBody() {
+      var err error
+      block, err = source.Block(blockInfo.Hash)
+      if err != nil {
+        return nil, err
+      }
+
+      // a skipped block was never indexed, so neither it nor any block
+      // after it may become the tip
+      if block == nil {
+        err = checkpoint(idx, last)
+        if err != nil {
+          return nil, err
+        }
+        return nil, errors.Errorf("Block %x at height %d was skipped, stopped indexing before it", blockInfo.Hash, height)
+      }
+    }
+
+    if idx.ShouldParseBlockInfo() {
+      err := idx.OnBlockInfo(height, total, blockInfo)
+      if err != nil {
+        return nil, err
+      }
+    }
+
+    if block != nil {
+      err := idx.OnBlock(height, total, block)
+      if err != nil {
+        return nil, err
+      }
+    }
+    last = blockInfo
+
+    blockCount++
+    if blockCount%1000 == 0 {
+      log.Printf("Indexed %d blocks up to height %d of %d in %s\n", blockCount, height, total-1, time.Since(start))
+    }
+
+    if time.Since(lastCheckpoint) >= checkpointInterval {
+      err := checkpoint(idx, last)
+      if err != nil {
+        return nil, err
+      }
+      lastCheckpoint = time.Now()
+    }
+  }
+
+  log.Printf("Indexing %d blocks took: %s\n", blockCount, time.Since(start))
+  return last, checkpoint(idx, last)
+}
+
+func checkpoint(idx indexer.Indexer, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  if blockInfo == nil {
+    return nil
+  }
+  return idx.OnCheckpoint(int(blockInfo.Height), blockInfo)
+}
@@ -0,0 +1,201 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package blockSource
+
+import (
+  "omnom/bitcoinBlockchainParser"
+  "omnom/indexer"
+  "testing"
+)
+
+// testSource serves a chain of count blocks. Blocks in skipped are
+// returned as nil.
+type testSource struct {
+  blockInfos []*bitcoinBlockchainParser.BlockInfo
+  skipped    map[[32]byte]bool
+}
+
+func newTestSource(count int) *testSource {
+  source := &testSource{skipped: make(map[[32]byte]bool)}
+  var prev *bitcoinBlockchainParser.BlockInfo
+  for i := 0; i < count; i++ {
+    blockInfo := new(bitcoinBlockchainParser.BlockInfo)
+    blockInfo.Hash[0] = byte(i + 1)
+    blockInfo.Height = uint64(i)
+    if prev != nil {
+      blockInfo.PrevHash = prev.Hash
+      blockInfo.PrevBlockInfo = prev
+      prev.NextBlockInfo = blockInfo
+    }
+    source.blockInfos = append(source.blockInfos, blockInfo)
+    prev = blockInfo
+  }
+  return source
+}
+
+func (source *testSource) Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error) {
+  first := source.blockInfos[0]
+  if start != nil {
+    first = source.blockInfos[start.Height]
+  }
+  last := source.blockInfos[len(source.blockInfos)-1]
+  return []*bitcoinBlockchainParser.Chain{{First: first, Last: last, Length: int(last.Height-first.Height) + 1}}, nil
+}
+
+func (source *testSource) Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error) {
+  if source.skipped[hash] {
+    return nil, nil
+  }
+  block := new(bitcoinBlockchainParser.Block)
+  block.Hash = hash
+  return block, nil
+}
+
+func (source *testSource) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  return nil
+}
+
+func (source *testSource) Close() error {
+  return nil
+}
+
+// testIndexer records the heights passed to it. onBlock is called for every
+// block if set.
+type testIndexer struct {
+  blockInfos  []int
+  blocks      []int
+  checkpoints []int
+  onBlock     func(height int)
+}
+
+func (idx *testIndexer) OnStart() (bool, error) { return false, nil }
+func (idx *testIndexer) OnEnd() error           { return nil }
+
+func (idx *testIndexer) OnBlockInfo(height int, blockCount int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  idx.blockInfos = append(idx.blockInfos, height)
+  return nil
+}
+
+func (idx *testIndexer) OnBlock(height int, blockCount int, block *bitcoinBlockchainParser.Block) error {
+  idx.blocks = append(idx.blocks, height)
+  if idx.onBlock != nil {
+    idx.onBlock(height)
+  }
+  return nil
+}
+
+func (idx *testIndexer) OnCheckpoint(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  idx.checkpoints = append(idx.checkpoints, height)
+  return nil
+}
+
+func (idx *testIndexer) OnRewind(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  return nil
+}
+
+func (idx *testIndexer) DBName() string { return "test" }
+
+func (idx *testIndexer) GetGenesisBlockInfo() (*bitcoinBlockchainParser.BlockInfo, error) {
+  return nil, nil
+}
+
+func (idx *testIndexer) GetTipBlockInfo() (*bitcoinBlockchainParser.BlockInfo, error) {
+  return nil, nil
+}
+
+func (idx *testIndexer) GetBlockCount() uint64 { return 0 }
+
+func (idx *testIndexer) ShouldParseBlockInfo() bool { return true }
+func (idx *testIndexer) ShouldParseBlockBody() bool { return true }
+
+func (idx *testIndexer) CheckBlockInfoEntries(*bitcoinBlockchainParser.Chain) error { return nil }
+func (idx *testIndexer) CleanupReorgCache(*bitcoinBlockchainParser.Chain) error     { return nil }
+
+func (idx *testIndexer) GetReorgCacheSize() int            { return 0 }
+func (idx *testIndexer) IndexSearch() indexer.IndexSearch { return nil }
+
+func equalHeights(a []int, b []int) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func TestSyncStopsBeforeSkippedBlock(t *testing.T) {
+  source := newTestSource(5)
+  source.skipped[source.blockInfos[3].Hash] = true
+  idx := new(testIndexer)
+
+  tip, err := Sync(source, idx, source.blockInfos[0], nil)
+  if err == nil {
+    t.Fatalf("Synced up to %d", tip.Height)
+  }
+  if !equalHeights(idx.blockInfos, []int{1, 2}) || !equalHeights(idx.blocks, []int{1, 2}) {
+    t.Errorf("Indexed block infos %v and blocks %v", idx.blockInfos, idx.blocks)
+  }
+  if !equalHeights(idx.checkpoints, []int{2}) {
+    t.Errorf("Checkpoints %v", idx.checkpoints)
+  }
+}
+
+func TestSyncResumesAfterInterrupt(t *testing.T) {
+  source := newTestSource(8)
+  stop := make(chan struct{})
+  idx := new(testIndexer)
+  idx.onBlock = func(height int) {
+    if height == 3 {
+      close(stop)
+    }
+  }
+
+  tip, err := Sync(source, idx, nil, stop)
+  if err != ErrInterrupted {
+    t.Fatalf("Sync returned %v", err)
+  }
+  // the block being indexed when stop was closed is finished
+  if tip != source.blockInfos[3] || !equalHeights(idx.blocks, []int{0, 1, 2, 3}) {
+    t.Fatalf("Interrupted at %v after blocks %v", tip, idx.blocks)
+  }
+  if !equalHeights(idx.checkpoints, []int{3}) {
+    t.Errorf("Checkpoints %v", idx.checkpoints)
+  }
+
+  idx.onBlock = nil
+  tip, err = Sync(source, idx, tip, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if tip != source.blockInfos[7] || !equalHeights(idx.blocks, []int{0, 1, 2, 3, 4, 5, 6, 7}) {
+    t.Errorf("Resumed up to %v with blocks %v", tip, idx.blocks)
+  }
+  if !equalHeights(idx.checkpoints, []int{3, 7}) {
+    t.Errorf("Checkpoints %v", idx.checkpoints)
+  }
+}
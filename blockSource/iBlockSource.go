@@ -0,0 +1,48 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package blockSource
+
+import (
+  "omnom/bitcoinBlockchainParser"
+)
+
+// BlockSource is where an indexer gets its blocks from: blk files,
+// bitcoind's JSON-RPC interface, ZMQ notifications or a peer
+type BlockSource interface {
+  // Headers returns the chains leading back to the parent of start, best
+  // first, with heights counted from start.Height. Without start the
+  // chains begin at the genesis block. No chain means start is not part of
+  // the source's block tree any more, a best chain starting at another
+  // child of the parent means a branch with more work replaced start.
+  Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error)
+  // Block returns the block with the given hash, which was returned by
+  // the last call to Headers. A nil block without error was skipped, Sync
+  // stops before it.
+  Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error)
+  // WatchTips calls onNewTip whenever the source might have a new tip,
+  // until stop is closed
+  WatchTips(onNewTip func() error, stop <-chan struct{}) error
+  Close() error
+}
@@ -27,7 +27,6 @@ package addressTxRocksDBIndex
 import (
   "bytes"
   "encoding/binary"
-  "fmt"
   "github.com/btcsuite/btcd/chaincfg"
   "github.com/btcsuite/btcd/txscript"
   "github.com/pkg/errors"
@@ -37,12 +36,40 @@ import (
   "omnom/indexer"
 )
 
+// layoutVersion is stored with the index and bumped whenever the key or
+// value format changes:
+//  1: no version stored, an appended txid list per address
+//  2: one key per posting
+//  3: block, transaction and height column families for all blocks
+//  4: funding and spending postings with amounts, outpoint column family
+//  5: undo column family, outpoints of all spendable outputs
+const layoutVersion = 5
+
+// Column families, in the order of cfNames
+const (
+  cfDefault = iota
+  cfAddress
+  cfTransaction
+  cfBlock
+  cfBlockInfo
+  cfHeight
+  cfOutpoint
+  cfUndo
+)
+
+// Undo operations, see blockBatch.undo
+const (
+  undoDelete  = 0
+  undoRestore = 1
+)
+
 type AddressTxRocksDBIndex struct {
   //db and statements
   db               *gorocksdb.DB
   options          *gorocksdb.Options
   readOptions      *gorocksdb.ReadOptions
   writeOptions     *gorocksdb.WriteOptions
+  syncWriteOptions *gorocksdb.WriteOptions
   cfNames          []string
   cfHandles        []*gorocksdb.ColumnFamilyHandle
   cfOptions        []*gorocksdb.Options
@@ -55,6 +82,23 @@ type AddressTxRocksDBIndex struct {
   tipBlockHash     [32]byte
   blockCount       uint64
   indexSearch      *AddressTxRocksDBIndexSearch
+  block            *blockBatch
+}
+
+// blockBatch holds the writes of the block being indexed until they are
+// committed together by commitBlock
+type blockBatch struct {
+  batch  *gorocksdb.WriteBatch
+  hash   [32]byte
+  height int
+  // outputs created by this block, see addOutput
+  outpoints map[string][]byte
+  // undo records how to revert every write of the block, it is stored
+  // with the block by commitBlock:
+  // hash | (undoDelete | cf | len(key) | key)* or
+  // (undoRestore | cf | len(key) | key | len(value) | value)*
+  // lengths are big endian, 2 bytes for keys and 4 for values
+  undo []byte
 }
 
 func NewAddressTxRocksDBIndex(chainCfg *chaincfg.Params) *AddressTxRocksDBIndex {
@@ -64,6 +108,7 @@ func NewAddressTxRocksDBIndex(chainCfg *chaincfg.Params) *AddressTxRocksDBIndex
   indexer.addressIndex = true
 
   indexer.reorgCacheSize = 10 // blocks
+  indexer.dbName = "address2tx"
 
   indexer.options = gorocksdb.NewDefaultOptions()
   indexer.options.EnableStatistics()
@@ -71,12 +116,14 @@ func NewAddressTxRocksDBIndex(chainCfg *chaincfg.Params) *AddressTxRocksDBIndex
   indexer.options.SetErrorIfExists(false)
   indexer.options.SetCreateIfMissingColumnFamilies(true)
   indexer.readOptions = gorocksdb.NewDefaultReadOptions()
+  // every write goes to the WAL, but it is only synced by checkpoints
   indexer.writeOptions = gorocksdb.NewDefaultWriteOptions()
-  indexer.writeOptions.DisableWAL(true)
   indexer.writeOptions.SetSync(false)
+  indexer.syncWriteOptions = gorocksdb.NewDefaultWriteOptions()
+  indexer.syncWriteOptions.SetSync(true)
   indexer.chainCfg = chainCfg
-  indexer.cfNames = []string{"default", "address", "transaction", "block", "blockinfo"}
-  indexer.cfOptions = []*gorocksdb.Options{indexer.options, indexer.options, indexer.options, indexer.options, indexer.options}
+  indexer.cfNames = []string{"default", "address", "transaction", "block", "blockinfo", "height", "outpoint", "undo"}
+  indexer.cfOptions = []*gorocksdb.Options{indexer.options, indexer.options, indexer.options, indexer.options, indexer.options, indexer.options, indexer.options, indexer.options}
   return indexer
 }
 
@@ -84,7 +131,6 @@ func (indexer *AddressTxRocksDBIndex) OnStart() (bool, error) {
 
   var err error
   existing := true
-  indexer.dbName = fmt.Sprintf("address2tx")
 
   db, cfHandles, err := gorocksdb.OpenDbColumnFamilies(indexer.options, indexer.dbName, indexer.cfNames, indexer.cfOptions)
   if err != nil {
@@ -97,7 +143,7 @@ func (indexer *AddressTxRocksDBIndex) OnStart() (bool, error) {
 
   //check if we have properties stored which tell us
   //that some index is already built
-  txs, err := indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[0], []byte("genesisBlockHash"))
+  txs, err := indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfDefault], []byte("genesisBlockHash"))
   if err != nil {
     return false, err
   }
@@ -109,7 +155,7 @@ func (indexer *AddressTxRocksDBIndex) OnStart() (bool, error) {
   }
   txs.Free()
 
-  txs, err = indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[0], []byte("tipBlockHash"))
+  txs, err = indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfDefault], []byte("tipBlockHash"))
   if err != nil {
     return false, err
   }
@@ -121,7 +167,7 @@ func (indexer *AddressTxRocksDBIndex) OnStart() (bool, error) {
   }
   txs.Free()
 
-  txs, err = indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[0], []byte("blockCount"))
+  txs, err = indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfDefault], []byte("blockCount"))
   if err != nil {
     return false, err
   }
@@ -133,6 +179,28 @@ func (indexer *AddressTxRocksDBIndex) OnStart() (bool, error) {
   }
   txs.Free()
 
+  txs, err = indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfDefault], []byte("layoutVersion"))
+  if err != nil {
+    return false, err
+  }
+
+  version := uint32(1)
+  if txs.Size() == 4 {
+    version = binary.LittleEndian.Uint32(txs.Data())
+  }
+  txs.Free()
+
+  if !existing {
+    bytes := make([]byte, 4)
+    binary.LittleEndian.PutUint32(bytes, layoutVersion)
+    err = indexer.db.PutCF(indexer.syncWriteOptions, indexer.cfHandles[cfDefault], []byte("layoutVersion"), bytes)
+    if err != nil {
+      return false, err
+    }
+  } else if version != layoutVersion {
+    return false, errors.Errorf("Index %s has layout version %d instead of %d, delete it to rebuild", indexer.dbName, version, layoutVersion)
+  }
+
   return existing, nil
 }
 
@@ -145,6 +213,8 @@ func (indexer *AddressTxRocksDBIndex) DB() interface{} {
 }
 
 func (indexer *AddressTxRocksDBIndex) OnEnd() error {
+  // a block still pending failed, finished ones are committed already
+  indexer.discardBlock()
 
   for i := 0; i < len(indexer.cfHandles); i++ {
     indexer.cfHandles[i].Destroy()
@@ -155,6 +225,7 @@ func (indexer *AddressTxRocksDBIndex) OnEnd() error {
   indexer.options.Destroy()
   indexer.readOptions.Destroy()
   indexer.writeOptions.Destroy()
+  indexer.syncWriteOptions.Destroy()
 
   return nil
 
@@ -170,6 +241,59 @@ func pack(byteArrayArray [][]byte) []byte {
   return result
 }
 
+// Posting kinds, stored in the posting key between txIndex and the index
+// of the output or input
+const (
+  postingFunding  = 0
+  postingSpending = 1
+)
+
+// postingKey returns the key of the posting of output or input index of the
+// txIndex-th transaction in the block at height involving address:
+// len(address) | address | height | txIndex | kind | index, numbers big
+// endian. The length keeps the prefix of one address from matching a longer
+// one, big endian numbers keep the postings of an address ordered by height.
+func postingKey(address string, height uint32, txIndex uint32, kind byte, index uint32) []byte {
+  key := make([]byte, 1+len(address)+13)
+  copy(key, addressPrefix(address))
+  binary.BigEndian.PutUint32(key[1+len(address):], height)
+  binary.BigEndian.PutUint32(key[5+len(address):], txIndex)
+  key[9+len(address)] = kind
+  binary.BigEndian.PutUint32(key[10+len(address):], index)
+  return key
+}
+
+// postingValue returns the value of a posting: txid | amount, the amount
+// in satoshis little endian
+func postingValue(txid [32]byte, amount uint64) []byte {
+  value := make([]byte, 40)
+  copy(value, txid[0:32])
+  binary.LittleEndian.PutUint64(value[32:], amount)
+  return value
+}
+
+// outpointKey returns the key of an unspent output in the outpoint column
+// family: txid | vout
+func outpointKey(txid [32]byte, vout uint32) []byte {
+  key := make([]byte, 36)
+  copy(key, txid[0:32])
+  binary.BigEndian.PutUint32(key[32:], vout)
+  return key
+}
+
+// heightKey returns the key of a block height in the height column family,
+// big endian to iterate in height order
+func heightKey(height int) []byte {
+  key := make([]byte, 4)
+  binary.BigEndian.PutUint32(key, uint32(height))
+  return key
+}
+
+// addressPrefix returns the prefix shared by all posting keys of address
+func addressPrefix(address string) []byte {
+  return append([]byte{byte(len(address))}, address...)
+}
+
 func unpack(bytes []byte) [][]byte {
   result := make([][]byte, 0)
   for i := 0; i < len(bytes); {
@@ -186,129 +310,360 @@ func unpack(bytes []byte) [][]byte {
 }
 
 func (indexer *AddressTxRocksDBIndex) OnBlockInfo(height int, total int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  err := indexer.beginBlock(height, blockInfo.Hash)
+  if err != nil {
+    return err
+  }
+
   if indexer.blockInfoIndex {
     // store away blockinfo, when historical index is done and new blocks are comming.
     // With this info we will be able to recsontruct the chain to the genesis block
     // and detect reorgs
     blockInfoBytes := blockInfo.ToBytes()
-    // write into blockinfo column family: 3
-    err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[4], blockInfo.Hash[0:32], blockInfoBytes)
-    if err != nil {
-      return err
-    }
+    indexer.put(cfBlockInfo, blockInfo.Hash[0:32], blockInfoBytes)
 
     if blockInfo.IsGenesis() {
-      err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[0], []byte("genesisBlockHash"), blockInfo.Hash[0:32])
-      if err != nil {
-        return err
-      }
-    } else if blockInfo.IsTip() {
-      err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[0], []byte("tipBlockHash"), blockInfo.Hash[0:32])
-      if err != nil {
-        return err
-      }
-    }
-
-    if height == total-1 {
-      bytes := make([]byte, 8)
-      binary.LittleEndian.PutUint64(bytes, uint64(total))
-      err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[0], []byte("blockCount"), bytes)
-      if err != nil {
-        return err
-      }
+      indexer.block.batch.PutCF(indexer.cfHandles[cfDefault], []byte("genesisBlockHash"), blockInfo.Hash[0:32])
     }
+  }
 
+  // without the address index there is no OnBlock to wait for
+  if !indexer.addressIndex {
+    return indexer.commitBlock()
   }
   return nil
 }
 
 func (indexer *AddressTxRocksDBIndex) OnBlock(height int, total int, currentBlock *bitcoinBlockchainParser.Block) error {
+  err := indexer.beginBlock(height, currentBlock.Hash)
+  if err != nil {
+    return err
+  }
 
   if indexer.addressIndex {
     // insert block into db
     txCount := len(currentBlock.Transactions)
-    blockTransactionMap := make(map[[32]byte]bool, 0)
+    transactionsBytes := make([]byte, 0, txCount*32)
 
     for i := 0; i < txCount; i++ {
-      if height > total-indexer.reorgCacheSize {
-        blockTransactionMap[currentBlock.Transactions[i].TxId] = true
-      }
-      txOutCount := len(currentBlock.Transactions[i].Outputs)
+      tx := &currentBlock.Transactions[i]
+      transactionsBytes = append(transactionsBytes, tx.TxId[0:32]...)
       transactionAddressMap := make(map[string]bool, 0)
+      addressBytesArray := make([][]byte, 0)
+      addAddress := func(address string) {
+        if !transactionAddressMap[address] {
+          transactionAddressMap[address] = true
+          addressBytesArray = append(addressBytesArray, []byte(address))
+        }
+      }
 
-      // todo: check inputs for "source addies" and add 1 or many flags bytes to mark if address/tx is from input or output
-      // also add varint for number of addies/tx
-      if indexer.addressIndex {
-        for j := 0; j < txOutCount; j++ {
-
-          if currentBlock.Transactions[i].Outputs[j].Script == nil ||
-              currentBlock.Transactions[i].Outputs[j].Script.Data == nil ||
-              len(currentBlock.Transactions[i].Outputs[j].Script.Data) == 0 {
-            continue
+      // the coinbase spends nothing
+      if i > 0 {
+        for j := 0; j < len(tx.Inputs); j++ {
+          addresses, value, err := indexer.spentOutput(&tx.Inputs[j])
+          if err != nil {
+            indexer.discardBlock()
+            return err
           }
-
-          _, targetAddresses, _, _ := txscript.ExtractPkScriptAddrs(currentBlock.Transactions[i].Outputs[j].Script.Data, indexer.chainCfg)
-
-          if targetAddresses != nil && len(targetAddresses) > 0 {
-            for k := 0; k < len(targetAddresses); k++ {
-              address := targetAddresses[k].EncodeAddress()
-              if height >= total-indexer.reorgCacheSize {
-                transactionAddressMap[address] = true
-              }
-
-              if indexer.addressIndex {
-                txs, err := indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[1], []byte( address ))
-                if err != nil {
-                  return err
-                }
-
-                var newData []byte
-
-                if txs.Size() > 0 {
-                  newData := make([]byte, txs.Size()+32)
-                  copy(newData[0:txs.Size()], txs.Data())
-                  copy(newData[txs.Size():txs.Size()+32], currentBlock.Transactions[i].TxId[0:32])
-                } else {
-                  newData = currentBlock.Transactions[i].TxId[0:32]
-                }
-
-                txs.Free()
-
-                err = indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[1], []byte( address ), newData)
-                if err != nil {
-                  return err
-                }
-              }
-            }
+          for k := 0; k < len(addresses); k++ {
+            addAddress(addresses[k])
+            key := postingKey(addresses[k], uint32(height), uint32(i), postingSpending, uint32(j))
+            indexer.put(cfAddress, key, postingValue(tx.TxId, value))
           }
         }
       }
-      if height >= total-indexer.reorgCacheSize {
-        addressBytesArray := make([][]byte, 0)
-        for k := range transactionAddressMap {
-          addressBytesArray = append(addressBytesArray, []byte(k))
+
+      for j := 0; j < len(tx.Outputs); j++ {
+        script := tx.Outputs[j].Script
+        if script != nil && txscript.IsUnspendable(script.Data) {
+          continue
         }
+        addresses := indexer.scriptAddresses(script)
+        for k := 0; k < len(addresses); k++ {
+          addAddress(addresses[k])
 
-        err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[2], currentBlock.Transactions[i].TxId[:], pack(addressBytesArray))
-        if err != nil {
-          return err
+          // one key per posting, appending never reads the history
+          key := postingKey(addresses[k], uint32(height), uint32(i), postingFunding, uint32(j))
+          indexer.put(cfAddress, key, postingValue(tx.TxId, tx.Outputs[j].Value))
         }
+        indexer.addOutput(tx.TxId, uint32(j), addresses, tx.Outputs[j].Value)
       }
 
-      if height >= total-indexer.reorgCacheSize {
-        txCount := len(blockTransactionMap)
-        transactionsBytes := make([]byte, txCount*32)
-        index := 0
-        for k := range blockTransactionMap {
-          copy(transactionsBytes[index*32:index*32+32], k[0:32])
-          index++
-        }
-        err := indexer.db.PutCF(indexer.writeOptions, indexer.cfHandles[3], currentBlock.Hash[0:32], transactionsBytes)
-        if err != nil {
-          return err
-        }
+      indexer.put(cfTransaction, tx.TxId[:], pack(addressBytesArray))
+    }
+
+    indexer.put(cfBlock, currentBlock.Hash[0:32], transactionsBytes)
+  }
+  return indexer.commitBlock()
+}
+
+// scriptAddresses returns the encoded addresses an output script pays to
+func (indexer *AddressTxRocksDBIndex) scriptAddresses(script *bitcoinBlockchainParser.Script) []string {
+  if script == nil || len(script.Data) == 0 {
+    return nil
+  }
+  _, targetAddresses, _, _ := txscript.ExtractPkScriptAddrs(script.Data, indexer.chainCfg)
+  addresses := make([]string, len(targetAddresses))
+  for k := 0; k < len(targetAddresses); k++ {
+    addresses[k] = targetAddresses[k].EncodeAddress()
+  }
+  return addresses
+}
+
+// addOutput stores the addresses and value of a spendable output until it
+// is spent, also if it has no address. Outputs of the pending block are
+// kept in memory too, a later transaction of the same block may spend
+// them.
+func (indexer *AddressTxRocksDBIndex) addOutput(txid [32]byte, vout uint32, addresses []string, value uint64) {
+  key := outpointKey(txid, vout)
+  data := make([]byte, 8)
+  binary.LittleEndian.PutUint64(data, value)
+  addressBytesArray := make([][]byte, len(addresses))
+  for k := 0; k < len(addresses); k++ {
+    addressBytesArray[k] = []byte(addresses[k])
+  }
+  data = append(data, pack(addressBytesArray)...)
+
+  indexer.block.outpoints[string(key)] = data
+  indexer.put(cfOutpoint, key, data)
+}
+
+// spentOutput returns the addresses and value of the output spent by input
+// and removes it from the outpoint column family. The prevout from undo
+// data is used if the block source resolved it. An output which is not
+// stored was never created or is spent already, the index does not match
+// the chain then.
+func (indexer *AddressTxRocksDBIndex) spentOutput(input *bitcoinBlockchainParser.TxInput) ([]string, uint64, error) {
+  // inputs keep the serialized byte order of the txid, TxId is reversed
+  txid := input.SourceTxHash
+  bitcoinBlockchainParser.ReverseBytes(txid[:])
+  key := outpointKey(txid, input.OutputIndex)
+
+  data, ok := indexer.block.outpoints[string(key)]
+  if ok {
+    delete(indexer.block.outpoints, string(key))
+  } else {
+    slice, err := indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfOutpoint], key)
+    if err != nil {
+      return nil, 0, err
+    }
+    data = append([]byte(nil), slice.Data()...)
+    slice.Free()
+  }
+  if len(data) < 8 {
+    return nil, 0, errors.Errorf("Output %x:%d is not indexed as unspent", txid, input.OutputIndex)
+  }
+  // the output is restored if the block is undone
+  indexer.delete(cfOutpoint, key, data)
+
+  if input.PrevOut != nil {
+    return indexer.scriptAddresses(input.PrevOut.Script), input.PrevOut.Value, nil
+  }
+
+  addressBytesArray := unpack(data[8:])
+  addresses := make([]string, len(addressBytesArray))
+  for k := 0; k < len(addressBytesArray); k++ {
+    addresses[k] = string(addressBytesArray[k])
+  }
+  return addresses, binary.LittleEndian.Uint64(data[0:8]), nil
+}
+
+// beginBlock starts the batch collecting all writes of the block with the
+// given hash. A block skipped by the decoder gets no OnBlock, its batch is
+// committed when the next one begins.
+func (indexer *AddressTxRocksDBIndex) beginBlock(height int, hash [32]byte) error {
+  if indexer.block != nil && indexer.block.hash == hash {
+    return nil
+  }
+  err := indexer.commitBlock()
+  if err != nil {
+    return err
+  }
+  indexer.block = &blockBatch{gorocksdb.NewWriteBatch(), hash, height, make(map[string][]byte), append([]byte(nil), hash[0:32]...)}
+  return nil
+}
+
+// put writes key to column family cf in the pending block and records its
+// removal in the block's undo data
+func (indexer *AddressTxRocksDBIndex) put(cf int, key []byte, value []byte) {
+  indexer.block.batch.PutCF(indexer.cfHandles[cf], key, value)
+  indexer.block.undo = appendUndo(indexer.block.undo, undoDelete, cf, key, nil)
+}
+
+// delete removes key with its current value from column family cf in the
+// pending block and records how to restore it in the block's undo data
+func (indexer *AddressTxRocksDBIndex) delete(cf int, key []byte, value []byte) {
+  indexer.block.batch.DeleteCF(indexer.cfHandles[cf], key)
+  indexer.block.undo = appendUndo(indexer.block.undo, undoRestore, cf, key, value)
+}
+
+// appendUndo appends one operation to undo data, see blockBatch.undo
+func appendUndo(undo []byte, operation byte, cf int, key []byte, value []byte) []byte {
+  length := make([]byte, 4)
+  undo = append(undo, operation, byte(cf))
+  binary.BigEndian.PutUint16(length, uint16(len(key)))
+  undo = append(undo, length[0:2]...)
+  undo = append(undo, key...)
+  if operation == undoRestore {
+    binary.BigEndian.PutUint32(length, uint32(len(value)))
+    undo = append(undo, length...)
+    undo = append(undo, value...)
+  }
+  return undo
+}
+
+// commitBlock writes the pending block together with the tip and block
+// count pointing to it in one batch, so the index never ends in the middle
+// of a block. The batch is not synced: the tip it writes survives a crash
+// of the process, but is durable against a crash of the machine only once
+// the next OnCheckpoint synced the WAL. After such a crash the index
+// resumes from an earlier complete block, the last checkpoint or later.
+// The tip in memory only advances once the batch was written.
+func (indexer *AddressTxRocksDBIndex) commitBlock() error {
+  block := indexer.block
+  if block == nil {
+    return nil
+  }
+  indexer.block = nil
+  defer block.batch.Destroy()
+
+  bytes := make([]byte, 8)
+  binary.LittleEndian.PutUint64(bytes, uint64(block.height+1))
+  block.batch.PutCF(indexer.cfHandles[cfHeight], heightKey(block.height), block.hash[0:32])
+  block.undo = appendUndo(block.undo, undoDelete, cfHeight, heightKey(block.height), nil)
+  block.batch.PutCF(indexer.cfHandles[cfDefault], []byte("tipBlockHash"), block.hash[0:32])
+  block.batch.PutCF(indexer.cfHandles[cfDefault], []byte("blockCount"), bytes)
+
+  // the undo data of a block is kept as long as a reorg may remove it
+  block.batch.PutCF(indexer.cfHandles[cfUndo], heightKey(block.height), block.undo)
+  if block.height >= indexer.reorgCacheSize {
+    block.batch.DeleteCF(indexer.cfHandles[cfUndo], heightKey(block.height-indexer.reorgCacheSize))
+  }
+
+  err := indexer.db.Write(indexer.writeOptions, block.batch)
+  if err != nil {
+    return err
+  }
+  indexer.tipBlockHash = block.hash
+  indexer.blockCount = uint64(block.height + 1)
+  return nil
+}
+
+// discardBlock drops the pending block, e.g. after an error left it half
+// indexed
+func (indexer *AddressTxRocksDBIndex) discardBlock() {
+  if indexer.block != nil {
+    indexer.block.batch.Destroy()
+    indexer.block = nil
+  }
+}
+
+// OnCheckpoint syncs the WAL with a synced write of blockInfo as tip, so
+// all blocks indexed before are durable too and the next start resumes
+// after blockInfo.
+func (indexer *AddressTxRocksDBIndex) OnCheckpoint(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  err := indexer.commitBlock()
+  if err != nil {
+    return err
+  }
+
+  bytes := make([]byte, 8)
+  binary.LittleEndian.PutUint64(bytes, uint64(height+1))
+
+  batch := gorocksdb.NewWriteBatch()
+  defer batch.Destroy()
+  batch.PutCF(indexer.cfHandles[cfDefault], []byte("tipBlockHash"), blockInfo.Hash[0:32])
+  batch.PutCF(indexer.cfHandles[cfDefault], []byte("blockCount"), bytes)
+  return indexer.db.Write(indexer.syncWriteOptions, batch)
+}
+
+// OnRewind reverts all writes of the tip blockInfo with the undo data
+// stored by commitBlock and makes its parent the tip, in one synced batch.
+func (indexer *AddressTxRocksDBIndex) OnRewind(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error {
+  err := indexer.commitBlock()
+  if err != nil {
+    return err
+  }
+  if blockInfo.Hash != indexer.tipBlockHash || uint64(height+1) != indexer.blockCount {
+    return errors.Errorf("Block %x at height %d is not the tip", blockInfo.Hash, height)
+  }
+
+  slice, err := indexer.db.GetCF(indexer.readOptions, indexer.cfHandles[cfUndo], heightKey(height))
+  if err != nil {
+    return err
+  }
+  undo := append([]byte(nil), slice.Data()...)
+  slice.Free()
+  if len(undo) < 32 || !bytes.Equal(undo[0:32], blockInfo.Hash[0:32]) {
+    return errors.Errorf("No undo data for block %x", blockInfo.Hash)
+  }
+
+  batch := gorocksdb.NewWriteBatch()
+  defer batch.Destroy()
+  err = applyUndo(batch, indexer.cfHandles, undo[32:])
+  if err != nil {
+    return errors.Wrapf(err, "Undo data of block %x", blockInfo.Hash)
+  }
+
+  count := make([]byte, 8)
+  binary.LittleEndian.PutUint64(count, uint64(height))
+  batch.DeleteCF(indexer.cfHandles[cfUndo], heightKey(height))
+  batch.PutCF(indexer.cfHandles[cfDefault], []byte("tipBlockHash"), blockInfo.PrevHash[0:32])
+  batch.PutCF(indexer.cfHandles[cfDefault], []byte("blockCount"), count)
+  err = indexer.db.Write(indexer.syncWriteOptions, batch)
+  if err != nil {
+    return err
+  }
+  indexer.tipBlockHash = blockInfo.PrevHash
+  indexer.blockCount = uint64(height)
+  return nil
+}
+
+// applyUndo adds the operations of undo data to batch, in reverse order
+// of the writes they revert
+func applyUndo(batch *gorocksdb.WriteBatch, cfHandles []*gorocksdb.ColumnFamilyHandle, undo []byte) error {
+  type operation struct {
+    kind  byte
+    cf    int
+    key   []byte
+    value []byte
+  }
+  operations := make([]operation, 0)
+  for i := 0; i < len(undo); {
+    if i+4 > len(undo) {
+      return errors.New("Truncated operation")
+    }
+    o := operation{kind: undo[i], cf: int(undo[i+1])}
+    keyLength := int(binary.BigEndian.Uint16(undo[i+2:]))
+    i += 4
+    if o.cf >= len(cfHandles) || i+keyLength > len(undo) {
+      return errors.New("Invalid operation")
+    }
+    o.key = undo[i : i+keyLength]
+    i += keyLength
+
+    if o.kind == undoRestore {
+      if i+4 > len(undo) {
+        return errors.New("Truncated operation")
       }
+      valueLength := int(binary.BigEndian.Uint32(undo[i:]))
+      i += 4
+      if i+valueLength > len(undo) {
+        return errors.New("Truncated operation")
+      }
+      o.value = undo[i : i+valueLength]
+      i += valueLength
+    } else if o.kind != undoDelete {
+      return errors.Errorf("Unknown operation %d", o.kind)
+    }
+    operations = append(operations, o)
+  }
 
+  for i := len(operations) - 1; i >= 0; i-- {
+    if operations[i].kind == undoRestore {
+      batch.PutCF(cfHandles[operations[i].cf], operations[i].key, operations[i].value)
+    } else {
+      batch.DeleteCF(cfHandles[operations[i].cf], operations[i].key)
     }
   }
   return nil
@@ -370,43 +725,31 @@ func (indexer *AddressTxRocksDBIndex) CheckBlockInfoEntries(longestChain *bitcoi
   return nil
 }
 
+// CleanupReorgCache moves the tip to the end of longestChain. Blocks which
+// left the best chain were undone by OnRewind before, so there is nothing
+// else to clean up.
 func (indexer *AddressTxRocksDBIndex) CleanupReorgCache(longestChain *bitcoinBlockchainParser.Chain) error {
-  if !bytes.Equal(longestChain.First.Hash[0:32], indexer.tipBlockHash[0:32]) {
-    return errors.New("Chain tip mismatch")
-  }
-  blockInfo := longestChain.Last
-  log.Println("Cleaning up reorg cache")
-  counter := 0
-  for blockInfo.PrevBlockInfo != nil {
-    if counter > indexer.reorgCacheSize {
-      // remove stuff here
-      txids, err := indexer.indexSearch.FindTransactionIdsByBlockHash(blockInfo.Hash[0:32])
-      if err == nil && txids == nil {
-        // assume everything b4 was also deleted and break
-        break
-      }
-
-      if txids != nil {
-        for t := 0; t < len(txids); t++ {
-          err = indexer.db.DeleteCF(indexer.writeOptions, indexer.cfHandles[2], txids[t][0:32])
-          if err != nil {
-            log.Printf("Error when deleting txid %x: %s", txids[t][0:32], err)
-          }
-        }
-      }
-
-      err = indexer.db.DeleteCF(indexer.writeOptions, indexer.cfHandles[3], blockInfo.Hash[0:32])
-      if err != nil {
-        log.Printf("Error when deleting blockInfo %x: %s", blockInfo.Hash[0:32], err)
-      }
+  err := indexer.commitBlock()
+  if err != nil {
+    return err
+  }
 
+  // the chain starts at the tip, or at an indexed block before it after a
+  // reorg. A new index has no tip yet.
+  if indexer.tipBlockHash != [32]byte{} && !bytes.Equal(longestChain.First.Hash[0:32], indexer.tipBlockHash[0:32]) {
+    first, err := indexer.indexSearch.FindBlockInfoByBlockHash(longestChain.First.Hash[0:32])
+    if err != nil {
+      return err
+    }
+    if first == nil {
+      return errors.New("Chain tip mismatch")
     }
-    blockInfo = blockInfo.PrevBlockInfo
-    counter++
   }
+  // the next chain starts at this one's end
+  indexer.tipBlockHash = longestChain.Last.Hash
+  indexer.blockCount = longestChain.Last.Height + 1
 
   return nil
-
 }
 
 func (indexer *AddressTxRocksDBIndex) GetReorgCacheSize() int {
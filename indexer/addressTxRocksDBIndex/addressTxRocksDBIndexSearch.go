@@ -25,6 +25,8 @@
 package addressTxRocksDBIndex
 
 import (
+  "encoding/binary"
+  "encoding/hex"
   "github.com/pkg/errors"
   "github.com/tecbot/gorocksdb"
   "omnom/bitcoinBlockchainParser"
@@ -44,16 +46,94 @@ func NewIndexSearch(db *gorocksdb.DB, readOptions *gorocksdb.ReadOptions, cfHand
   return s
 }
 
+// Posting is one output paying to an address or one input spending from
+// it. Index is the index of the output or input in the transaction.
+type Posting struct {
+  TxId     [32]byte
+  Height   uint32
+  TxIndex  uint32
+  Index    uint32
+  Spending bool
+  Amount   uint64
+}
+
+// FindPostingsByAddress returns the postings of address ordered by height
+// and position in the block, in a transaction the funding ones first
+func (s *AddressTxRocksDBIndexSearch) FindPostingsByAddress(address string) ([]*Posting, error) {
+  prefix := addressPrefix(address)
+  iter := s.db.NewIteratorCF(s.readOptions, s.cfHandles[cfAddress])
+  defer iter.Close()
+
+  var result []*Posting
+  for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+    key := iter.Key()
+    value := iter.Value()
+    keyData := key.Data()[len(prefix):]
+    valueData := value.Data()
+    if len(keyData) != 13 || len(valueData) != 40 {
+      key.Free()
+      value.Free()
+      return nil, errors.Errorf("Invalid posting of %s", address)
+    }
+
+    posting := new(Posting)
+    copy(posting.TxId[0:32], valueData[0:32])
+    posting.Amount = binary.LittleEndian.Uint64(valueData[32:40])
+    posting.Height = binary.BigEndian.Uint32(keyData[0:4])
+    posting.TxIndex = binary.BigEndian.Uint32(keyData[4:8])
+    posting.Spending = keyData[8] == postingSpending
+    posting.Index = binary.BigEndian.Uint32(keyData[9:13])
+    key.Free()
+    value.Free()
+
+    result = append(result, posting)
+  }
+
+  return result, iter.Err()
+}
+
+// FindTransactionIdsByAddress returns the ids of all transactions paying to
+// or spending from address, ordered by height and position in the block
 func (s *AddressTxRocksDBIndexSearch) FindTransactionIdsByAddress(address string) ([][]byte, error) {
-  return nil, nil
+  postings, err := s.FindPostingsByAddress(address)
+  if err != nil {
+    return nil, err
+  }
+
+  var result [][]byte
+  seen := make(map[[32]byte]bool)
+  for i := 0; i < len(postings); i++ {
+    // a transaction can have several postings of the same address
+    if !seen[postings[i].TxId] {
+      seen[postings[i].TxId] = true
+      result = append(result, postings[i].TxId[0:32])
+    }
+  }
+
+  return result, nil
 }
 
+// FindAddressesByTransactionId returns the addresses the transaction with
+// the given hex txid spends from or pays to
 func (s *AddressTxRocksDBIndexSearch) FindAddressesByTransactionId(txid string) ([][]byte, error) {
-  return nil, nil
+  txidBytes, err := hex.DecodeString(txid)
+  if err != nil || len(txidBytes) != 32 {
+    return nil, errors.Errorf("Invalid txid %s", txid)
+  }
+
+  bytes, err := s.getBytesCF(txidBytes, s.cfHandles[cfTransaction])
+  if err != nil {
+    return nil, err
+  }
+  if bytes == nil {
+    return nil, nil
+  }
+
+  return unpack(bytes), nil
 }
 
 func (s *AddressTxRocksDBIndexSearch) FindTransactionIdsByBlockHash(blockHash []byte) ([][32]byte, error) {
-  bytes, err := s.getBytesCF(blockHash, s.cfHandles[3])
+  bytes, err := s.getBytesCF(blockHash, s.cfHandles[cfBlock])
 
   if err != nil {
     return nil, err
@@ -75,19 +155,42 @@ func (s *AddressTxRocksDBIndexSearch) FindTransactionIdsByBlockHash(blockHash []
 }
 
 func (s *AddressTxRocksDBIndexSearch) FindTransactionIdsByBlockHeight(blockHeight int) ([][]byte, error) {
-  return nil, nil
+  blockHash, err := s.FindBlockHashByBlockHeight(blockHeight)
+  if err != nil || blockHash == nil {
+    return nil, err
+  }
+
+  txids, err := s.FindTransactionIdsByBlockHash(blockHash)
+  if err != nil {
+    return nil, err
+  }
+
+  result := make([][]byte, len(txids))
+  for i := 0; i < len(txids); i++ {
+    result[i] = txids[i][0:32]
+  }
+
+  return result, nil
 }
 
+// FindBlockHashByBlockHeight returns the hash of the block at blockHeight
+// in the indexed chain
 func (s *AddressTxRocksDBIndexSearch) FindBlockHashByBlockHeight(blockHeight int) ([]byte, error) {
-  return nil, nil
+  if blockHeight < 0 {
+    return nil, errors.Errorf("Invalid height %d", blockHeight)
+  }
+  return s.getBytesCF(heightKey(blockHeight), s.cfHandles[cfHeight])
 }
 
 func (s *AddressTxRocksDBIndexSearch) FindBlockInfoByBlockHash(blockHash []byte) (*bitcoinBlockchainParser.BlockInfo, error) {
-  bytes, err := s.getBytesCF(blockHash, s.cfHandles[4])
+  bytes, err := s.getBytesCF(blockHash, s.cfHandles[cfBlockInfo])
 
   if err != nil {
     return nil, err
   }
+  if bytes == nil {
+    return nil, nil
+  }
 
   blockInfo := bitcoinBlockchainParser.BlockInfoFromBytes(blockHash, bytes, nil)
 
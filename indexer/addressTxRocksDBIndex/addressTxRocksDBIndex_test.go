@@ -0,0 +1,320 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package addressTxRocksDBIndex
+
+import (
+  "bytes"
+  "fmt"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/txscript"
+  "github.com/btcsuite/btcd/wire"
+  "omnom/bitcoinBlockchainParser"
+  "omnom/testFixture"
+  "path"
+  "reflect"
+  "testing"
+)
+
+var testChainCfg = &chaincfg.RegressionNetParams
+
+// testChain builds blocks for the index under test
+type testChain struct {
+  t   *testing.T
+  idx *AddressTxRocksDBIndex
+}
+
+func newTestChain(t *testing.T) *testChain {
+  idx := NewAddressTxRocksDBIndex(testChainCfg)
+  idx.dbName = path.Join(t.TempDir(), "address2tx")
+  existing, err := idx.OnStart()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if existing {
+    t.Fatal("new index is not empty")
+  }
+  t.Cleanup(func() {
+    idx.OnEnd()
+  })
+  return &testChain{t, idx}
+}
+
+// script returns a P2PKH script, n makes the address unique
+func (c *testChain) script(n byte) []byte {
+  script := []byte{txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20}
+  script = append(script, bytes.Repeat([]byte{n}, 20)...)
+  return append(script, txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG)
+}
+
+func (c *testChain) address(n byte) string {
+  _, addresses, _, err := txscript.ExtractPkScriptAddrs(c.script(n), testChainCfg)
+  if err != nil || len(addresses) != 1 {
+    c.t.Fatal("no address for script", err)
+  }
+  return addresses[0].EncodeAddress()
+}
+
+// coinbase pays value to address n, tag makes it unique
+func (c *testChain) coinbase(tag uint32, n byte, value int64) *wire.MsgTx {
+  return testFixture.NewCoinbase(tag, value, c.script(n))
+}
+
+// spend spends output vout of prev and pays the given values to addresses,
+// ordered by address
+func (c *testChain) spend(prev *wire.MsgTx, vout uint32, outputs map[byte]int64) *wire.MsgTx {
+  tx := wire.NewMsgTx(1)
+  prevHash := prev.TxHash()
+  tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prevHash, vout), []byte{txscript.OP_TRUE}, nil))
+  for n := byte(0); n < 255; n++ {
+    if value, ok := outputs[n]; ok {
+      tx.AddTxOut(wire.NewTxOut(value, c.script(n)))
+    }
+  }
+  return tx
+}
+
+// block decodes a block with txs on top of prev like a block source would
+func (c *testChain) block(prev *bitcoinBlockchainParser.BlockInfo, txs ...*wire.MsgTx) (*bitcoinBlockchainParser.BlockInfo, *bitcoinBlockchainParser.Block) {
+  prevHash := chainhash.Hash{}
+  height := uint64(0)
+  if prev != nil {
+    copy(prevHash[:], prev.Hash[:])
+    bitcoinBlockchainParser.ReverseBytes(prevHash[:])
+    height = prev.Height + 1
+  }
+
+  msg := testFixture.NewBlock(c.t, prevHash, int64(1500000000+600*height), testChainCfg.PowLimitBits, txs...)
+  var buffer bytes.Buffer
+  err := msg.Serialize(&buffer)
+  if err != nil {
+    c.t.Fatal(err)
+  }
+  block, err := bitcoinBlockchainParser.DecodeBlock(&buffer, testChainCfg)
+  if err != nil {
+    c.t.Fatal(err)
+  }
+
+  blockInfo := bitcoinBlockchainParser.NewBlockInfoFromBlock(block)
+  blockInfo.Height = height
+  return blockInfo, block
+}
+
+func (c *testChain) index(blockInfo *bitcoinBlockchainParser.BlockInfo, block *bitcoinBlockchainParser.Block) {
+  err := c.idx.OnBlockInfo(int(blockInfo.Height), 0, blockInfo)
+  if err != nil {
+    c.t.Fatal(err)
+  }
+  err = c.idx.OnBlock(int(blockInfo.Height), 0, block)
+  if err != nil {
+    c.t.Fatal(err)
+  }
+}
+
+// postings returns the postings of address n as strings like "f1:30",
+// funding 30 at height 1, or "s2:20", spending 20 at height 2
+func (c *testChain) postings(n byte) []string {
+  postings, err := c.idx.indexSearch.FindPostingsByAddress(c.address(n))
+  if err != nil {
+    c.t.Fatal(err)
+  }
+  result := make([]string, 0)
+  for _, posting := range postings {
+    kind := "f"
+    if posting.Spending {
+      kind = "s"
+    }
+    result = append(result, fmt.Sprintf("%s%d:%d", kind, posting.Height, posting.Amount))
+  }
+  return result
+}
+
+func (c *testChain) expectPostings(n byte, expected ...string) {
+  if postings := c.postings(n); fmt.Sprint(postings) != fmt.Sprint(expected) {
+    c.t.Fatalf("address %d has postings %v, expected %v", n, postings, expected)
+  }
+}
+
+func (c *testChain) expectHeight(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) {
+  hash, err := c.idx.indexSearch.FindBlockHashByBlockHeight(height)
+  if err != nil {
+    c.t.Fatal(err)
+  }
+  if blockInfo == nil && hash != nil || blockInfo != nil && !bytes.Equal(hash, blockInfo.Hash[:]) {
+    c.t.Fatalf("height %d has block %x", height, hash)
+  }
+}
+
+func (c *testChain) expectTip(blockInfo *bitcoinBlockchainParser.BlockInfo) {
+  tip, err := c.idx.GetTipBlockInfo()
+  if err != nil {
+    c.t.Fatal(err)
+  }
+  if tip == nil || tip.Hash != blockInfo.Hash || c.idx.GetBlockCount() != blockInfo.Height+1 {
+    c.t.Fatalf("tip is %v with %d blocks, expected %x", tip, c.idx.GetBlockCount(), blockInfo.Hash)
+  }
+}
+
+func TestIndexConformance(t *testing.T) {
+  c := newTestChain(t)
+
+  coinbase0 := c.coinbase(0, 1, 50)
+  info0, block0 := c.block(nil, coinbase0)
+  c.index(info0, block0)
+
+  // tx1 pays 20 back to 1 and 30 to 3, tx2 spends tx1 in the same block
+  tx1 := c.spend(coinbase0, 0, map[byte]int64{1: 20, 3: 30})
+  tx2 := c.spend(tx1, 0, map[byte]int64{4: 20})
+  info1, block1 := c.block(info0, c.coinbase(1, 2, 50), tx1, tx2)
+  c.index(info1, block1)
+
+  tx3 := c.spend(tx1, 1, map[byte]int64{5: 30})
+  info2, block2 := c.block(info1, c.coinbase(2, 2, 50), tx3)
+  c.index(info2, block2)
+
+  c.expectPostings(1, "f0:50", "f1:20", "s1:50", "s1:20")
+  c.expectPostings(2, "f1:50", "f2:50")
+  c.expectPostings(3, "f1:30", "s2:30")
+  c.expectPostings(4, "f1:20")
+  c.expectPostings(5, "f2:30")
+  c.expectHeight(2, info2)
+  c.expectTip(info2)
+
+  txids, err := c.idx.indexSearch.FindTransactionIdsByBlockHeight(1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(txids) != 3 || !bytes.Equal(txids[1], block1.Transactions[1].TxId[:]) {
+    t.Fatalf("block 1 has transactions %x", txids)
+  }
+
+  addresses, err := c.idx.indexSearch.FindAddressesByTransactionId(block1.Transactions[1].TxIdString())
+  if err != nil {
+    t.Fatal(err)
+  }
+  expected := [][]byte{[]byte(c.address(1)), []byte(c.address(3))}
+  if !reflect.DeepEqual(addresses, expected) {
+    t.Fatalf("tx1 has addresses %s", addresses)
+  }
+}
+
+func TestIndexRewind(t *testing.T) {
+  c := newTestChain(t)
+
+  coinbase0 := c.coinbase(0, 1, 50)
+  info0, block0 := c.block(nil, coinbase0)
+  c.index(info0, block0)
+
+  tx1 := c.spend(coinbase0, 0, map[byte]int64{2: 30, 3: 20})
+  info1, block1 := c.block(info0, c.coinbase(1, 1, 50), tx1)
+  c.index(info1, block1)
+
+  // block 2 spends the output of tx1 to 2, the competing block 2' spends
+  // the same output to another address
+  info2, block2 := c.block(info1, c.coinbase(2, 1, 50), c.spend(tx1, 0, map[byte]int64{4: 30}))
+  c.index(info2, block2)
+  c.expectPostings(2, "f1:30", "s2:30")
+  c.expectPostings(4, "f2:30")
+
+  // rewinding a block which is not the tip fails
+  err := c.idx.OnRewind(1, info1)
+  if err == nil {
+    t.Fatal("rewound a block below the tip")
+  }
+
+  err = c.idx.OnRewind(2, info2)
+  if err != nil {
+    t.Fatal(err)
+  }
+  c.expectTip(info1)
+  c.expectHeight(2, nil)
+  c.expectPostings(1, "f0:50", "f1:50", "s1:50")
+  c.expectPostings(2, "f1:30")
+  c.expectPostings(4)
+  txids, err := c.idx.indexSearch.FindTransactionIdsByBlockHash(info2.Hash[:])
+  if err != nil || len(txids) != 0 {
+    t.Fatalf("rewound block has transactions %x, %v", txids, err)
+  }
+  blockInfo, err := c.idx.indexSearch.FindBlockInfoByBlockHash(info2.Hash[:])
+  if err != nil || blockInfo != nil {
+    t.Fatalf("rewound block has block info %v, %v", blockInfo, err)
+  }
+
+  info2b, block2b := c.block(info1, c.coinbase(3, 1, 50), c.spend(tx1, 0, map[byte]int64{5: 30}))
+  c.index(info2b, block2b)
+  info3b, block3b := c.block(info2b, c.coinbase(4, 1, 50))
+  c.index(info3b, block3b)
+
+  c.expectTip(info3b)
+  c.expectHeight(2, info2b)
+  c.expectHeight(3, info3b)
+  c.expectPostings(2, "f1:30", "s2:30")
+  c.expectPostings(4)
+  c.expectPostings(5, "f2:30")
+
+  // the index survives a restart with the new tip
+  err = c.idx.OnEnd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  dbName := c.idx.dbName
+  c.idx = NewAddressTxRocksDBIndex(testChainCfg)
+  c.idx.dbName = dbName
+  existing, err := c.idx.OnStart()
+  if err != nil || !existing {
+    t.Fatal("index not found after restart", err)
+  }
+  c.expectTip(info3b)
+}
+
+func TestIndexSpendsOutputsWithoutAddress(t *testing.T) {
+  c := newTestChain(t)
+
+  coinbase0 := c.coinbase(0, 1, 50)
+  coinbase0.AddTxOut(wire.NewTxOut(10, []byte{txscript.OP_TRUE}))
+  coinbase0.AddTxOut(wire.NewTxOut(0, []byte{txscript.OP_RETURN, txscript.OP_DATA_1, 0x01}))
+  info0, block0 := c.block(nil, coinbase0)
+  c.index(info0, block0)
+
+  // the output without address is spent like any other
+  info1, block1 := c.block(info0, c.coinbase(1, 1, 50), c.spend(coinbase0, 1, map[byte]int64{2: 10}))
+  c.index(info1, block1)
+  c.expectPostings(2, "f1:10")
+
+  // spending an output twice, or one which was never created, is an error
+  for _, vout := range []uint32{1, 2, 3} {
+    info2, block2 := c.block(info1, c.coinbase(2, 1, 50), c.spend(coinbase0, vout, map[byte]int64{3: 10}))
+    err := c.idx.OnBlockInfo(2, 0, info2)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = c.idx.OnBlock(2, 0, block2)
+    if err == nil {
+      t.Fatalf("spending output %d did not fail", vout)
+    }
+  }
+  c.expectTip(info1)
+  c.expectPostings(3)
+}
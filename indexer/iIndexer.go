@@ -33,6 +33,12 @@ type Indexer interface {
   OnEnd() error
   OnBlockInfo(height int, blockCount int, blockInfo *bitcoinBlockchainParser.BlockInfo) error
   OnBlock(height int, blockCount int, block *bitcoinBlockchainParser.Block) error
+  // OnCheckpoint makes everything indexed up to blockInfo durable and
+  // records it as the tip to resume from
+  OnCheckpoint(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error
+  // OnRewind undoes the indexed tip blockInfo at height, which left the
+  // best chain in a reorg. Its parent becomes the tip.
+  OnRewind(height int, blockInfo *bitcoinBlockchainParser.BlockInfo) error
   DBName() string
 
   GetGenesisBlockInfo() (*bitcoinBlockchainParser.BlockInfo, error)
@@ -38,130 +38,96 @@ zmqpubrawtx=tcp://0.0.0.0:18502
  */
 
  import (
+  "flag"
   "fmt"
-  "github.com/btcsuite/btcd/chaincfg"
   "log"
   "omnom/bitcoinBlockchainParser"
   "omnom/indexer"
   "omnom/indexer/addressTxRocksDBIndex"
-  "path"
+  "os"
 )
 
 func main() {
 
-  var idx indexer.Indexer
-  idx = addressTxRocksDBIndex.NewAddressTxRocksDBIndex(&chaincfg.TestNet3Params)
-  existing, err := idx.OnStart()
-
-  //existing = false
+  network := flag.String("chain", "testnet3", "chain to index: mainnet, testnet3, regtest or signet")
+  blocksDirectory := flag.String("blocks", "", "bitcoind's blocks directory, defaults to the one of -chain in ~/.bitcoin")
+  headerCacheFile := flag.String("headercache", "headerCache.dat", "file caching the headers scanned in the blk files, empty to disable")
+  follow := flag.Bool("follow", false, "keep indexing new blocks until interrupted")
+  progressFormat := flag.String("progress", "log", "how to report parser progress: log, json (one event per line on stdout, command output moves to stderr) or none")
+  flag.Usage = func() {
+    fmt.Fprintln(os.Stderr, usage)
+    flag.PrintDefaults()
+  }
+  flag.Parse()
 
+  chainCfg, err := chainParams(*network)
   if err != nil {
-    fmt.Println(err)
-    return
+    log.Fatal(err)
+  }
+  progress, err := progressReporter(*progressFormat)
+  if err != nil {
+    log.Fatal(err)
+  }
+  if *blocksDirectory == "" {
+    *blocksDirectory, err = defaultBlocksDirectory(chainCfg)
+    if err != nil {
+      log.Fatal(err)
+    }
   }
 
-  bp := bitcoinBlockchainParser.NewBitcoinBlockchainParser(path.Join("testnet3_157", "blocks"), idx.OnBlockInfo, idx.OnBlock)
-
-  if !existing {
-    // parse historic data
-    log.Println("Starting to build index")
-    opts := bitcoinBlockchainParser.NewBitcoinBlockchainParserDefaultOptions()
-    //opts.CallBlockCallback = false
-    //opts.CallBlockInfoCallback = false
+  // commands other than the block sources only read the blk files and
+  // never touch the index
+  args := flag.Args()
+  command := ""
+  if len(args) > 0 {
+    command = args[0]
+  }
 
-    // look for chains with current tip as root
-    blockMap, blockOrder, err := bp.CollectBlockInfo(opts)
+  switch command {
+  case "", "follow", "zmq", "rpc", "p2p":
+  default:
+    // with json progress stdout only carries the events
+    output := os.Stdout
+    if *progressFormat == "json" {
+      output = os.Stderr
+    }
+    bp := bitcoinBlockchainParser.NewBitcoinBlockchainParser(*blocksDirectory, chainCfg, nil, nil)
+    err := runCommand(bp, args, progress, output)
     if err != nil {
-      log.Fatalf("Error in collecting block info: %s", err)
-      return
+      log.Fatal(err)
     }
+    return
+  }
 
-    chains, err := bp.FindChains(blockMap, blockOrder, opts)
-
-    if err == nil && len(chains) > 0 {
-      err = bp.ParseBlocks(chains[0], opts)
+  if (command == "zmq" || command == "rpc" || command == "p2p") && len(args) < 2 {
+    log.Fatal(usage)
+  }
 
-      if err != nil {
-        fmt.Println(err)
-      }
+  source, err := newBlockSource(args, chainCfg, *blocksDirectory, *headerCacheFile, progress)
+  if err != nil {
+    log.Fatal(err)
+  }
 
-      err = idx.CleanupReorgCache(chains[0])
+  var idx indexer.Indexer
+  idx = addressTxRocksDBIndex.NewAddressTxRocksDBIndex(chainCfg)
+  existing, err := idx.OnStart()
 
-      if err != nil {
-        fmt.Println(err)
-      }
+  //existing = false
 
-    }
-  } else {
-    log.Println("Found index...")
-    log.Println("Checking index consistency...")
-
-
-    for i:=0; i<idx.GetReorgCacheSize(); i++ {
-      tipBlockInfo, err := idx.GetTipBlockInfo()
-
-      // walk back index blockInfo to genesis block
-      opts := bitcoinBlockchainParser.NewBitcoinBlockchainParserDefaultOptions()
-      //opts.CallBlockCallback = false
-      //opts.CallBlockInfoCallback = false
-      opts.BlkFilePosition = tipBlockInfo.BlkFilePosition
-      opts.BlkFileNumber = tipBlockInfo.BlkFileNumber
-      opts.StopAtPrevHash = tipBlockInfo.PrevHash
-      opts.StartBlockHeight = idx.GetBlockCount() - 1
-
-      // look for chains with current tip as root
-      blockMap, blockOrder, err := bp.CollectBlockInfo(opts)
-      if err != nil {
-        log.Fatalf("Error in collecting block info: %s", err)
-        break
-      }
-
-      chains, err := bp.FindChains(blockMap, blockOrder, opts)
-
-      if err != nil && len(chains) == 0 {
-        // this means there is no data in the blk files
-        // leading back to the current tip in the index. -> Reorg
-        // we need to walk back the indexed chain and check for
-        // blocks connecting to a previous tip. If we find a chain
-        // linked to a previous tip, we need to remove all indexed
-        // data for the dangling chain and then update the reorg cache
-
-        // TODO: test in regtest
-        tipBlockInfo, err = idx.IndexSearch().FindBlockInfoByBlockHash( tipBlockInfo.PrevHash[0:32] )
-        if err != nil {
-          fmt.Println(err)
-        }
-      } else {
-        if chains[0].First == chains[0].Last {
-          // everything ok.
-          log.Println("No new blocks found" )
-        } else {
-          // also ok!
-          log.Printf("Last tip:    %x\n", tipBlockInfo.Hash)
-          log.Printf("Chain first: %x\n", chains[0].First.Hash)
-          log.Printf("Chain last:  %x\n", chains[0].Last.Hash)
-          log.Printf("Total len:   %d\n", int(chains[0].Length)+int(opts.StartBlockHeight))
-
-          // Start reading blocks from block files
-          err = bp.ParseBlocks(chains[0], opts)
-
-          if err != nil {
-            fmt.Println(err)
-          }
-
-          err = idx.CleanupReorgCache(chains[0])
-
-          if err != nil {
-            fmt.Println(err)
-          }
-        }
-        break
-      }
-    }
+  if err != nil {
+    source.Close()
+    log.Fatal(err)
   }
 
+  err = indexFrom(source, idx, existing, *follow || command == "follow" || command == "zmq")
+
+  source.Close()
   idx.OnEnd()
 
+  if err != nil {
+    log.Fatal(err)
+  }
+
   /*
   options :=  gorocksdb.NewDefaultOptions()
   options.SetCreateIfMissing(false)
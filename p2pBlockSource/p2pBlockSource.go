@@ -0,0 +1,498 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package p2pBlockSource
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "github.com/pkg/errors"
+  "io"
+  "math/rand"
+  "net"
+  "omnom/bitcoinBlockchainParser"
+  "time"
+)
+
+type P2PBlockSourceOptions struct {
+  BlocksInFlight int
+  Timeout        time.Duration
+  PollInterval   time.Duration
+}
+
+// messageHeaderSize is the size of magic, command, length and checksum
+// preceding every message
+const messageHeaderSize = 24
+
+// errStartNotFound means the peer does not know the start block
+var errStartNotFound = errors.New("Peer does not know the start block")
+
+// P2PBlockSource syncs headers and blocks directly from a peer speaking the
+// Bitcoin wire protocol, so no local bitcoind data directory is needed.
+// Headers are checked like headers found in blk files.
+//
+// It connects on the first call to Headers and keeps the connection until
+// Close.
+type P2PBlockSource struct {
+  address  string
+  chainCfg *chaincfg.Params
+
+  conn            net.Conn
+  protocolVersion uint32
+  timeout         time.Duration
+
+  options    *P2PBlockSourceOptions
+  blockInfos map[[32]byte]*bitcoinBlockchainParser.BlockInfo
+  blocks     map[[32]byte]*bitcoinBlockchainParser.Block
+  tip        *bitcoinBlockchainParser.BlockInfo
+}
+
+func NewP2PBlockSource(address string, chainCfg *chaincfg.Params) *P2PBlockSource {
+  source := new(P2PBlockSource)
+  source.address = address
+  source.chainCfg = chainCfg
+  source.protocolVersion = wire.ProtocolVersion
+  source.options = NewP2PBlockSourceDefaultOptions()
+  return source
+}
+
+func NewP2PBlockSourceDefaultOptions() *P2PBlockSourceOptions {
+  o := new(P2PBlockSourceOptions)
+  o.BlocksInFlight = 16
+  o.Timeout = 2 * time.Minute
+  o.PollInterval = 30 * time.Second
+  return o
+}
+
+// SetOptions sets the options used by the BlockSource methods
+func (source *P2PBlockSource) SetOptions(options *P2PBlockSourceOptions) {
+  source.options = options
+}
+
+// Connect opens the connection and does the version handshake
+func (source *P2PBlockSource) Connect(options *P2PBlockSourceOptions) error {
+  conn, err := net.DialTimeout("tcp", source.address, options.Timeout)
+  if err != nil {
+    return err
+  }
+  return source.Handshake(conn, options)
+}
+
+// Handshake does the version handshake on an already open connection
+func (source *P2PBlockSource) Handshake(conn net.Conn, options *P2PBlockSourceOptions) error {
+  source.conn = conn
+  source.timeout = options.Timeout
+
+  me := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+  you := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+  if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+    you = wire.NewNetAddressIPPort(tcpAddr.IP, uint16(tcpAddr.Port), 0)
+  }
+  version := wire.NewMsgVersion(me, you, rand.Uint64(), 0)
+  version.DisableRelayTx = true
+  version.AddUserAgent("omnom", "0.1")
+
+  err := source.send(version)
+  if err != nil {
+    source.Close()
+    return err
+  }
+
+  gotVersion, gotVerAck := false, false
+  for !gotVersion || !gotVerAck {
+    msg, _, err := source.receive()
+    if err != nil {
+      source.Close()
+      return err
+    }
+
+    switch m := msg.(type) {
+    case *wire.MsgVersion:
+      if m.Services&wire.SFNodeWitness == 0 {
+        source.Close()
+        return errors.New("Peer does not serve witness blocks")
+      }
+      if uint32(m.ProtocolVersion) < source.protocolVersion {
+        source.protocolVersion = uint32(m.ProtocolVersion)
+      }
+      gotVersion = true
+      err = source.send(wire.NewMsgVerAck())
+      if err != nil {
+        source.Close()
+        return err
+      }
+    case *wire.MsgVerAck:
+      gotVerAck = true
+    }
+  }
+  return nil
+}
+
+func (source *P2PBlockSource) Close() error {
+  if source.conn == nil {
+    return nil
+  }
+  err := source.conn.Close()
+  source.conn = nil
+  return err
+}
+
+// syncHeaders downloads all headers after startAfter, the last block
+// already known with its height, or after the genesis block, up to the
+// peer's tip. They are checked and linked into a chain like FindChains
+// returns them. The chain is nil if the peer has no new headers,
+// errStartNotFound is returned if it does not know startAfter.
+func (source *P2PBlockSource) syncHeaders(startAfter *bitcoinBlockchainParser.BlockInfo) (*bitcoinBlockchainParser.Chain, error) {
+  chain := new(bitcoinBlockchainParser.Chain)
+
+  prev := startAfter
+  if prev == nil {
+    genesis := blockInfoFromHeader(&source.chainCfg.GenesisBlock.Header)
+    genesis.ChainWork = blockchain.CalcWork(genesis.Bits)
+    chain.First = genesis
+    chain.Last = genesis
+    chain.Length = 1
+    prev = genesis
+  }
+
+  for {
+    headers, err := source.getHeaders(prev.Hash)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, header := range headers.Headers {
+      blockInfo := blockInfoFromHeader(header)
+      if blockInfo.PrevHash != prev.Hash {
+        if prev == startAfter {
+          // the peer sent the headers after its last block in common
+          return nil, errStartNotFound
+        }
+        return nil, errors.Errorf("Header %x does not extend %x", blockInfo.Hash, prev.Hash)
+      }
+      blockInfo.Height = prev.Height + 1
+
+      err = bitcoinBlockchainParser.CheckHeader(blockInfo, prev, source.chainCfg)
+      if err != nil {
+        return nil, err
+      }
+
+      work := blockchain.CalcWork(blockInfo.Bits)
+      if prev.ChainWork != nil {
+        work.Add(work, prev.ChainWork)
+      }
+      blockInfo.ChainWork = work
+      blockInfo.PrevBlockInfo = prev
+      prev.NextBlockInfo = blockInfo
+      blockInfo.PartOfChain = true
+
+      if chain.First == nil {
+        chain.First = blockInfo
+      }
+      chain.Last = blockInfo
+      chain.Length++
+      prev = blockInfo
+    }
+
+    if len(headers.Headers) < wire.MaxBlockHeadersPerMsg {
+      break
+    }
+  }
+
+  if chain.First == nil {
+    return nil, nil
+  }
+  return chain, nil
+}
+
+// Headers syncs the headers from start on, or from the genesis block, and
+// returns them as the only chain. There is no chain if the peer does not
+// know start.
+func (source *P2PBlockSource) Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error) {
+  if source.conn == nil {
+    err := source.Connect(source.options)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  chain, err := source.syncHeaders(start)
+  if err == errStartNotFound {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  // the chain starts at start, like chains found in blk files
+  if start != nil {
+    if chain == nil {
+      chain = new(bitcoinBlockchainParser.Chain)
+      chain.Last = start
+    }
+    chain.First = start
+    chain.Length++
+    start.PartOfChain = true
+  }
+
+  source.blockInfos = make(map[[32]byte]*bitcoinBlockchainParser.BlockInfo)
+  source.blocks = make(map[[32]byte]*bitcoinBlockchainParser.Block)
+  for blockInfo := chain.First; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    source.blockInfos[blockInfo.Hash] = blockInfo
+  }
+  source.tip = chain.Last
+  return []*bitcoinBlockchainParser.Chain{chain}, nil
+}
+
+// Block returns the block with the given hash. Up to
+// options.BlocksInFlight blocks following it in the chain are requested
+// along with it.
+func (source *P2PBlockSource) Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error) {
+  block := source.blocks[hash]
+  if block != nil {
+    delete(source.blocks, hash)
+    return block, nil
+  }
+
+  blockInfo := source.blockInfos[hash]
+  if blockInfo == nil {
+    return nil, errors.Errorf("Block %x is not in the synced headers", hash)
+  }
+
+  blocksInFlight := source.options.BlocksInFlight
+  if blocksInFlight < 1 {
+    blocksInFlight = 1
+  }
+
+  batch := make([]*bitcoinBlockchainParser.BlockInfo, 0, blocksInFlight)
+  for next := blockInfo; next != nil && len(batch) < blocksInFlight; next = next.NextBlockInfo {
+    batch = append(batch, next)
+  }
+  received, err := source.requestBlocks(batch)
+  if err != nil {
+    return nil, err
+  }
+  for blockHash, block := range received {
+    source.blocks[blockHash] = block
+  }
+
+  block = source.blocks[hash]
+  delete(source.blocks, hash)
+  return block, nil
+}
+
+// WatchTips asks the peer for headers after the last synced tip every
+// options.PollInterval and calls onNewTip if there are any, until stop is
+// closed
+func (source *P2PBlockSource) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  ticker := time.NewTicker(source.options.PollInterval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-stop:
+      return nil
+    case <-ticker.C:
+    }
+
+    if source.tip != nil {
+      headers, err := source.getHeaders(source.tip.Hash)
+      if err != nil {
+        return err
+      }
+      if len(headers.Headers) == 0 {
+        continue
+      }
+    }
+
+    err := onNewTip()
+    if err != nil {
+      return err
+    }
+  }
+}
+
+// getHeaders asks for the headers following the block with the given hash
+// and waits for the answer
+func (source *P2PBlockSource) getHeaders(hash [32]byte) (*wire.MsgHeaders, error) {
+  getHeaders := wire.NewMsgGetHeaders()
+  getHeaders.ProtocolVersion = source.protocolVersion
+  locator := chainhash.Hash(hash)
+  bitcoinBlockchainParser.ReverseBytes(locator[:])
+  err := getHeaders.AddBlockLocatorHash(&locator)
+  if err != nil {
+    return nil, err
+  }
+  err = source.send(getHeaders)
+  if err != nil {
+    return nil, err
+  }
+
+  for {
+    msg, _, err := source.receive()
+    if err != nil {
+      return nil, err
+    }
+    if headers, ok := msg.(*wire.MsgHeaders); ok {
+      return headers, nil
+    }
+  }
+}
+
+// requestBlocks requests the blocks of batch with their witnesses and waits
+// until all of them arrived
+func (source *P2PBlockSource) requestBlocks(batch []*bitcoinBlockchainParser.BlockInfo) (map[[32]byte]*bitcoinBlockchainParser.Block, error) {
+  getData := wire.NewMsgGetDataSizeHint(uint(len(batch)))
+  for i := 0; i < len(batch); i++ {
+    hash := chainhash.Hash(batch[i].Hash)
+    bitcoinBlockchainParser.ReverseBytes(hash[:])
+    err := getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash))
+    if err != nil {
+      return nil, err
+    }
+  }
+  err := source.send(getData)
+  if err != nil {
+    return nil, err
+  }
+
+  received := make(map[[32]byte]*bitcoinBlockchainParser.Block)
+  for i := 0; i < len(batch); i++ {
+    for received[batch[i].Hash] == nil {
+      block, err := source.receiveBlock()
+      if err != nil {
+        return nil, err
+      }
+      received[block.Hash] = block
+    }
+
+    // headers do not tell the size of their block
+    batch[i].Size = received[batch[i].Hash].Size
+  }
+  return received, nil
+}
+
+// receiveBlock waits for the next block message and decodes its payload
+// with the parser's decoder. Offsets of a DecodeError are relative to the
+// payload.
+func (source *P2PBlockSource) receiveBlock() (*bitcoinBlockchainParser.Block, error) {
+  for {
+    msg, block, err := source.receive()
+    if err != nil {
+      return nil, err
+    }
+    if block != nil {
+      return bitcoinBlockchainParser.DecodeBlock(bytes.NewReader(block), source.chainCfg)
+    }
+    if _, ok := msg.(*wire.MsgNotFound); ok {
+      return nil, errors.New("Peer does not have a requested block")
+    }
+  }
+}
+
+func (source *P2PBlockSource) send(msg wire.Message) error {
+  err := source.conn.SetWriteDeadline(time.Now().Add(source.timeout))
+  if err != nil {
+    return err
+  }
+  _, err = wire.WriteMessageWithEncodingN(source.conn, msg, source.protocolVersion, source.chainCfg.Net, wire.WitnessEncoding)
+  return err
+}
+
+// receive returns the next message. The payload of a block message is
+// returned as is instead, so it is decoded once by receiveBlock. Pings are
+// answered and messages of unknown type or with a wrong checksum are
+// skipped.
+func (source *P2PBlockSource) receive() (wire.Message, []byte, error) {
+  header := make([]byte, messageHeaderSize)
+  for {
+    err := source.conn.SetReadDeadline(time.Now().Add(source.timeout))
+    if err != nil {
+      return nil, nil, err
+    }
+
+    _, err = io.ReadFull(source.conn, header)
+    if err != nil {
+      return nil, nil, err
+    }
+    if binary.LittleEndian.Uint32(header[0:4]) != uint32(source.chainCfg.Net) {
+      return nil, nil, errors.Errorf("Message for network %x", header[0:4])
+    }
+    command := string(bytes.TrimRight(header[4:16], "\x00"))
+    length := binary.LittleEndian.Uint32(header[16:20])
+    if length > wire.MaxMessagePayload {
+      return nil, nil, errors.Errorf("%s message of %d bytes exceeds the maximum payload", command, length)
+    }
+    payload := make([]byte, length)
+    _, err = io.ReadFull(source.conn, payload)
+    if err != nil {
+      return nil, nil, err
+    }
+    if !bytes.Equal(chainhash.DoubleHashB(payload)[0:4], header[20:24]) {
+      continue
+    }
+
+    if command == wire.CmdBlock {
+      return nil, payload, nil
+    }
+
+    // other messages are small, wire parses them from the bytes read
+    message := bytes.NewReader(append(header, payload...))
+    _, msg, _, err := wire.ReadMessageWithEncodingN(message, source.protocolVersion, source.chainCfg.Net, wire.WitnessEncoding)
+    if _, ok := err.(*wire.MessageError); ok {
+      continue
+    }
+    if err != nil {
+      return nil, nil, err
+    }
+
+    if ping, ok := msg.(*wire.MsgPing); ok {
+      err = source.send(wire.NewMsgPong(ping.Nonce))
+      if err != nil {
+        return nil, nil, err
+      }
+      continue
+    }
+    return msg, nil, nil
+  }
+}
+
+func blockInfoFromHeader(header *wire.BlockHeader) *bitcoinBlockchainParser.BlockInfo {
+  blockInfo := new(bitcoinBlockchainParser.BlockInfo)
+  hash := header.BlockHash()
+  copy(blockInfo.Hash[:], hash[:])
+  bitcoinBlockchainParser.ReverseBytes(blockInfo.Hash[:])
+  copy(blockInfo.PrevHash[:], header.PrevBlock[:])
+  bitcoinBlockchainParser.ReverseBytes(blockInfo.PrevHash[:])
+  blockInfo.Version = uint32(header.Version)
+  blockInfo.Timestamp = uint32(header.Timestamp.Unix())
+  blockInfo.Bits = header.Bits
+  blockInfo.Status = bitcoinBlockchainParser.BlockValidTree
+  return blockInfo
+}
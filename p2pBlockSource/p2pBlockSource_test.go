@@ -0,0 +1,276 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package p2pBlockSource
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "net"
+  "omnom/bitcoinBlockchainParser"
+  "omnom/testFixture"
+  "testing"
+  "time"
+)
+
+// testChainCfg are testnet rules with the regtest proof of work limit, so
+// test blocks are mined quickly but minimum difficulty blocks are allowed
+var testChainCfg = func() *chaincfg.Params {
+  params := chaincfg.TestNet3Params
+  params.PowLimit = chaincfg.RegressionNetParams.PowLimit
+  params.PowLimitBits = chaincfg.RegressionNetParams.PowLimitBits
+  return &params
+}()
+
+// fakePeer serves its blocks over the Bitcoin wire protocol to every
+// connection. With truncate the last byte of every block is left out.
+type fakePeer struct {
+  listener net.Listener
+  blocks   []*wire.MsgBlock
+  truncate bool
+}
+
+func newFakePeer(t *testing.T, blocks []*wire.MsgBlock) *fakePeer {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  peer := &fakePeer{listener: listener, blocks: blocks}
+  go func() {
+    for {
+      conn, err := listener.Accept()
+      if err != nil {
+        return
+      }
+      go peer.serve(conn)
+    }
+  }()
+  t.Cleanup(func() {
+    listener.Close()
+  })
+  return peer
+}
+
+func (peer *fakePeer) serve(conn net.Conn) {
+  defer conn.Close()
+  send := func(msg wire.Message) error {
+    _, err := wire.WriteMessageWithEncodingN(conn, msg, wire.ProtocolVersion, testChainCfg.Net, wire.WitnessEncoding)
+    return err
+  }
+
+  for {
+    _, msg, _, err := wire.ReadMessageWithEncodingN(conn, wire.ProtocolVersion, testChainCfg.Net, wire.WitnessEncoding)
+    if err != nil {
+      return
+    }
+
+    switch m := msg.(type) {
+    case *wire.MsgVersion:
+      address := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+      version := wire.NewMsgVersion(address, address, 1, int32(len(peer.blocks)))
+      version.Services = wire.SFNodeNetwork | wire.SFNodeWitness
+      err = send(version)
+      if err == nil {
+        err = send(wire.NewMsgVerAck())
+      }
+    case *wire.MsgGetHeaders:
+      // headers after the locator, or all of them if it is unknown
+      first := 0
+      for i := 0; i < len(peer.blocks); i++ {
+        if peer.blocks[i].BlockHash() == *m.BlockLocatorHashes[0] {
+          first = i + 1
+        }
+      }
+      headers := wire.NewMsgHeaders()
+      for i := first; i < len(peer.blocks); i++ {
+        headers.AddBlockHeader(&peer.blocks[i].Header)
+      }
+      err = send(headers)
+    case *wire.MsgGetData:
+      for _, inv := range m.InvList {
+        for i := 0; i < len(peer.blocks); i++ {
+          if peer.blocks[i].BlockHash() == inv.Hash && peer.truncate {
+            err = sendTruncated(conn, peer.blocks[i])
+          } else if peer.blocks[i].BlockHash() == inv.Hash {
+            err = send(peer.blocks[i])
+          }
+        }
+      }
+    }
+    if err != nil {
+      return
+    }
+  }
+}
+
+// sendTruncated sends block without its last byte in a block message with
+// a valid header and checksum
+func sendTruncated(conn net.Conn, block *wire.MsgBlock) error {
+  var payload bytes.Buffer
+  err := block.Serialize(&payload)
+  if err != nil {
+    return err
+  }
+  data := payload.Bytes()[0 : payload.Len()-1]
+
+  header := make([]byte, 24)
+  binary.LittleEndian.PutUint32(header[0:4], uint32(testChainCfg.Net))
+  copy(header[4:16], wire.CmdBlock)
+  binary.LittleEndian.PutUint32(header[16:20], uint32(len(data)))
+  copy(header[20:24], chainhash.DoubleHashB(data)[0:4])
+  _, err = conn.Write(append(header, data...))
+  return err
+}
+
+// newTestBlocks mines count minimum difficulty blocks on top of prev, ten
+// minutes apart
+func newTestBlocks(t *testing.T, prev chainhash.Hash, timestamp int64, count int) []*wire.MsgBlock {
+  blocks := make([]*wire.MsgBlock, 0, count)
+  for i := 0; i < count; i++ {
+    coinbase := testFixture.NewCoinbase(uint32(i), 50, []byte{0x51})
+    block := testFixture.NewBlock(t, prev, timestamp+int64(i+1)*600, testChainCfg.PowLimitBits, coinbase)
+    blocks = append(blocks, block)
+    prev = block.BlockHash()
+  }
+  return blocks
+}
+
+func testHash(hash chainhash.Hash) [32]byte {
+  var reversed [32]byte
+  copy(reversed[:], hash[:])
+  bitcoinBlockchainParser.ReverseBytes(reversed[:])
+  return reversed
+}
+
+// testStart returns the block info of the block the index stopped at, as
+// loaded from the index
+func testStart(hash chainhash.Hash, bits uint32, timestamp int64) *bitcoinBlockchainParser.BlockInfo {
+  blockInfo := new(bitcoinBlockchainParser.BlockInfo)
+  blockInfo.Bits = bits
+  blockInfo.Timestamp = uint32(timestamp)
+  start := bitcoinBlockchainParser.BlockInfoFromBytes(hash[:], blockInfo.ToBytes(), nil)
+  copy(start.Hash[:], hash[:])
+  bitcoinBlockchainParser.ReverseBytes(start.Hash[:])
+  start.Height = 100
+  return start
+}
+
+func TestHeadersResumesAfterStart(t *testing.T) {
+  startHash := chainhash.Hash{0x01}
+  timestamp := int64(1500000000)
+  blocks := newTestBlocks(t, startHash, timestamp, 5)
+  peer := newFakePeer(t, blocks)
+
+  // an index written before bits were stored has none for its tip
+  for _, bits := range []uint32{testChainCfg.PowLimitBits, 0} {
+    source := NewP2PBlockSource(peer.listener.Addr().String(), testChainCfg)
+    options := NewP2PBlockSourceDefaultOptions()
+    options.Timeout = 10 * time.Second
+    options.BlocksInFlight = 2
+    source.SetOptions(options)
+
+    start := testStart(startHash, bits, timestamp)
+    chains, err := source.Headers(start)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(chains) != 1 || chains[0].First != start || chains[0].Length != 6 || chains[0].Last.Height != 105 {
+      t.Fatalf("unexpected chains %+v", chains)
+    }
+
+    i := 0
+    for blockInfo := start.NextBlockInfo; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+      block, err := source.Block(blockInfo.Hash)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if block.Hash != testHash(blocks[i].BlockHash()) || blockInfo.Size != block.Size {
+        t.Fatalf("block %d is %x", i, block.Hash)
+      }
+      i++
+    }
+    if i != len(blocks) {
+      t.Fatalf("read %d blocks", i)
+    }
+    source.Close()
+  }
+}
+
+func TestHeadersChecksRetargetRules(t *testing.T) {
+  // after a block which is not of minimum difficulty, a block less than
+  // twenty minutes later must not be of minimum difficulty either
+  startHash := chainhash.Hash{0x01}
+  timestamp := int64(1500000000)
+  peer := newFakePeer(t, newTestBlocks(t, startHash, timestamp, 2))
+
+  source := NewP2PBlockSource(peer.listener.Addr().String(), testChainCfg)
+  defer source.Close()
+  _, err := source.Headers(testStart(startHash, 0x1f7fffff, timestamp))
+  if _, ok := err.(*bitcoinBlockchainParser.InvalidHeaderError); !ok {
+    t.Fatalf("expected an invalid header, got %v", err)
+  }
+}
+
+func TestHeadersWithUnknownStart(t *testing.T) {
+  startHash := chainhash.Hash{0x01}
+  timestamp := int64(1500000000)
+  peer := newFakePeer(t, newTestBlocks(t, startHash, timestamp, 3))
+
+  source := NewP2PBlockSource(peer.listener.Addr().String(), testChainCfg)
+  defer source.Close()
+  chains, err := source.Headers(testStart(chainhash.Hash{0x02}, testChainCfg.PowLimitBits, timestamp))
+  if err != nil || len(chains) != 0 {
+    t.Fatalf("found %d chains after an unknown block, %v", len(chains), err)
+  }
+}
+
+func TestBlockReturnsDecodeError(t *testing.T) {
+  startHash := chainhash.Hash{0x01}
+  timestamp := int64(1500000000)
+  blocks := newTestBlocks(t, startHash, timestamp, 1)
+  peer := newFakePeer(t, blocks)
+  peer.truncate = true
+
+  source := NewP2PBlockSource(peer.listener.Addr().String(), testChainCfg)
+  defer source.Close()
+  start := testStart(startHash, testChainCfg.PowLimitBits, timestamp)
+  _, err := source.Headers(start)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // the lock time of the coinbase is cut short, the offset in the payload
+  // is where the data ended
+  _, err = source.Block(start.NextBlockInfo.Hash)
+  decodeError, ok := err.(*bitcoinBlockchainParser.DecodeError)
+  if !ok {
+    t.Fatalf("expected a decode error, got %v", err)
+  }
+  if decodeError.Field != "lock time" || decodeError.Offset != int64(blocks[0].SerializeSize()-1) {
+    t.Errorf("decode error in %s at offset %d", decodeError.Field, decodeError.Offset)
+  }
+}
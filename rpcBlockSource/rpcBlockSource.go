@@ -0,0 +1,299 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package rpcBlockSource
+
+import (
+  "bytes"
+  "fmt"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/pkg/errors"
+  "omnom/bitcoinBlockchainParser"
+  "sync"
+  "time"
+)
+
+// headers are small, fetch many at once
+const headersPerRequest = 2000
+
+type RpcBlockSourceOptions struct {
+  BatchSize    int
+  FetchWorkers int
+  PollInterval time.Duration
+}
+
+// RpcBlockSource fetches blocks with getblockhash and getblock from
+// bitcoind's JSON-RPC interface, for setups which cannot read the blk files.
+// It serves the headers of bitcoind's active chain and fetches blocks ahead
+// along that chain. Requests are batched and up to FetchWorkers batches are
+// fetched and decoded in parallel.
+type RpcBlockSource struct {
+  client   *rpcClient
+  chainCfg *chaincfg.Params
+
+  options    *RpcBlockSourceOptions
+  blockInfos map[[32]byte]*bitcoinBlockchainParser.BlockInfo
+  blocks     map[[32]byte]*bitcoinBlockchainParser.Block
+  bestHash   string
+}
+
+func NewRpcBlockSource(rawUrl string, chainCfg *chaincfg.Params) (*RpcBlockSource, error) {
+  client, err := newRpcClient(rawUrl)
+  if err != nil {
+    return nil, err
+  }
+  source := new(RpcBlockSource)
+  source.client = client
+  source.chainCfg = chainCfg
+  source.options = NewRpcBlockSourceDefaultOptions()
+  return source, nil
+}
+
+func NewRpcBlockSourceDefaultOptions() *RpcBlockSourceOptions {
+  o := new(RpcBlockSourceOptions)
+  o.BatchSize = 16
+  o.FetchWorkers = 4
+  o.PollInterval = 5 * time.Second
+  return o
+}
+
+// SetOptions sets the options used by the BlockSource methods
+func (source *RpcBlockSource) SetOptions(options *RpcBlockSourceOptions) {
+  source.options = options
+}
+
+// Headers fetches the headers of bitcoind's active chain from start on, or
+// from the genesis block, and returns them as the only chain. There is no
+// chain if start is not part of the active chain any more.
+func (source *RpcBlockSource) Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error) {
+  count, err := source.client.getBlockCount()
+  if err != nil {
+    return nil, err
+  }
+
+  chain := new(bitcoinBlockchainParser.Chain)
+  source.blockInfos = make(map[[32]byte]*bitcoinBlockchainParser.BlockInfo)
+  source.blocks = make(map[[32]byte]*bitcoinBlockchainParser.Block)
+
+  height := uint64(0)
+  prev := start
+  if start != nil {
+    if start.Height >= count {
+      return nil, nil
+    }
+    hashes, err := source.client.getBlockHashes(start.Height, 1)
+    if err != nil {
+      return nil, err
+    }
+    if hashes[0] != fmt.Sprintf("%x", start.Hash) {
+      return nil, nil
+    }
+
+    chain.First = start
+    chain.Last = start
+    chain.Length = 1
+    source.blockInfos[start.Hash] = start
+    height = start.Height + 1
+  }
+
+  for height < count {
+    n := headersPerRequest
+    if uint64(n) > count-height {
+      n = int(count - height)
+    }
+
+    hashes, err := source.client.getBlockHashes(height, n)
+    if err != nil {
+      return nil, err
+    }
+    headers, err := source.client.getRawHeaders(hashes)
+    if err != nil {
+      return nil, err
+    }
+
+    for i := 0; i < n; i++ {
+      blockInfo, err := bitcoinBlockchainParser.NewBlockInfoFromHeader(headers[i])
+      if err != nil {
+        return nil, err
+      }
+      if fmt.Sprintf("%x", blockInfo.Hash) != hashes[i] {
+        return nil, errors.Errorf("Got header %x instead of %s", blockInfo.Hash, hashes[i])
+      }
+      if prev != nil && blockInfo.PrevHash != prev.Hash {
+        return nil, errors.Errorf("Header %x at height %d does not extend %x, the chain changed while fetching", blockInfo.Hash, height, prev.Hash)
+      }
+
+      blockInfo.Height = height
+      blockInfo.ChainWork = blockchain.CalcWork(blockInfo.Bits)
+      if prev != nil {
+        if prev.ChainWork != nil {
+          blockInfo.ChainWork.Add(blockInfo.ChainWork, prev.ChainWork)
+        }
+        blockInfo.PrevBlockInfo = prev
+        prev.NextBlockInfo = blockInfo
+      }
+      blockInfo.Status = bitcoinBlockchainParser.BlockValidTree
+      blockInfo.PartOfChain = true
+
+      if chain.First == nil {
+        chain.First = blockInfo
+      }
+      chain.Last = blockInfo
+      chain.Length++
+      source.blockInfos[blockInfo.Hash] = blockInfo
+      prev = blockInfo
+      height++
+    }
+  }
+
+  source.bestHash = fmt.Sprintf("%x", chain.Last.Hash)
+  return []*bitcoinBlockchainParser.Chain{chain}, nil
+}
+
+// Block returns the block with the given hash. Up to BatchSize times
+// FetchWorkers blocks following it in the chain are fetched along with it.
+func (source *RpcBlockSource) Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error) {
+  block := source.blocks[hash]
+  if block == nil {
+    batchSize, workers := fetchLimits(source.options)
+
+    hashes := []string{fmt.Sprintf("%x", hash)}
+    if blockInfo := source.blockInfos[hash]; blockInfo != nil {
+      for next := blockInfo.NextBlockInfo; next != nil && len(hashes) < batchSize*workers; next = next.NextBlockInfo {
+        hashes = append(hashes, fmt.Sprintf("%x", next.Hash))
+      }
+    }
+
+    blocks, err := source.fetchBlocks(hashes, batchSize)
+    if err != nil {
+      return nil, err
+    }
+    if source.blocks == nil {
+      source.blocks = make(map[[32]byte]*bitcoinBlockchainParser.Block)
+    }
+    for i := 0; i < len(blocks); i++ {
+      source.blocks[blocks[i].Hash] = blocks[i]
+    }
+    block = blocks[0]
+  }
+  delete(source.blocks, hash)
+
+  // headers do not tell the size of their block
+  if blockInfo := source.blockInfos[hash]; blockInfo != nil {
+    blockInfo.Size = block.Size
+  }
+  return block, nil
+}
+
+// WatchTips polls getbestblockhash every options.PollInterval and calls
+// onNewTip when it changed, until stop is closed
+func (source *RpcBlockSource) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  ticker := time.NewTicker(source.options.PollInterval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-stop:
+      return nil
+    case <-ticker.C:
+    }
+
+    hash, err := source.client.getBestBlockHash()
+    if err != nil {
+      return err
+    }
+    if hash == source.bestHash {
+      continue
+    }
+    source.bestHash = hash
+
+    err = onNewTip()
+    if err != nil {
+      return err
+    }
+  }
+}
+
+func (source *RpcBlockSource) Close() error {
+  return nil
+}
+
+func fetchLimits(options *RpcBlockSourceOptions) (int, int) {
+  batchSize := options.BatchSize
+  if batchSize < 1 {
+    batchSize = 1
+  }
+  workers := options.FetchWorkers
+  if workers < 1 {
+    workers = 1
+  }
+  return batchSize, workers
+}
+
+// fetchBlocks fetches and decodes the blocks in batches of batchSize, all
+// batches in parallel
+func (source *RpcBlockSource) fetchBlocks(hashes []string, batchSize int) ([]*bitcoinBlockchainParser.Block, error) {
+  blocks := make([]*bitcoinBlockchainParser.Block, len(hashes))
+  errs := make([]error, len(hashes))
+
+  var wait sync.WaitGroup
+  for start := 0; start < len(hashes); start += batchSize {
+    end := start + batchSize
+    if end > len(hashes) {
+      end = len(hashes)
+    }
+
+    wait.Add(1)
+    go func(start int, end int) {
+      defer wait.Done()
+
+      raw, err := source.client.getRawBlocks(hashes[start:end])
+      if err != nil {
+        errs[start] = err
+        return
+      }
+      for i := start; i < end; i++ {
+        blocks[i], err = bitcoinBlockchainParser.DecodeBlock(bytes.NewReader(raw[i-start]), source.chainCfg)
+        if err != nil {
+          errs[start] = err
+          return
+        }
+        if fmt.Sprintf("%x", blocks[i].Hash) != hashes[i] {
+          errs[start] = errors.Errorf("Got block %x instead of %s", blocks[i].Hash, hashes[i])
+          return
+        }
+      }
+    }(start, end)
+  }
+  wait.Wait()
+
+  for i := 0; i < len(errs); i++ {
+    if errs[i] != nil {
+      return nil, errs[i]
+    }
+  }
+  return blocks, nil
+}
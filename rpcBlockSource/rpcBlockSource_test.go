@@ -0,0 +1,264 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package rpcBlockSource
+
+import (
+  "bytes"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "net/http"
+  "net/http/httptest"
+  "omnom/testFixture"
+  "reflect"
+  "strings"
+  "sync"
+  "testing"
+)
+
+var testChainCfg = &chaincfg.RegressionNetParams
+
+// fakeNode answers the JSON-RPC batches of rpcClient like bitcoind with an
+// active chain of blocks. It records the size of every batch by method.
+type fakeNode struct {
+  server  *httptest.Server
+  blocks  [][]byte
+  hashes  []string
+  mutex   sync.Mutex
+  batches map[string][]int
+  // fail returns the error of a request, if any
+  fail func(method string, params []interface{}) *rpcError
+}
+
+func newFakeNode(t *testing.T, count int) *fakeNode {
+  node := &fakeNode{batches: make(map[string][]int)}
+  prev := chainhash.Hash{}
+  for i := 0; i < count; i++ {
+    coinbase := testFixture.NewCoinbase(uint32(i), 50, []byte{0x51})
+    block := testFixture.NewBlock(t, prev, 1500000000+int64(i)*600, testChainCfg.PowLimitBits, coinbase)
+
+    var buffer bytes.Buffer
+    err := block.Serialize(&buffer)
+    if err != nil {
+      t.Fatal(err)
+    }
+    prev = block.BlockHash()
+    node.blocks = append(node.blocks, buffer.Bytes())
+    node.hashes = append(node.hashes, prev.String())
+  }
+
+  node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+  t.Cleanup(node.server.Close)
+  return node
+}
+
+// url returns the url of the node with credentials
+func (node *fakeNode) url() string {
+  return strings.Replace(node.server.URL, "http://", "http://user:password@", 1)
+}
+
+func (node *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+  user, password, _ := r.BasicAuth()
+  if user != "user" || password != "password" {
+    w.WriteHeader(http.StatusUnauthorized)
+    return
+  }
+
+  var requests []rpcRequest
+  err := json.NewDecoder(r.Body).Decode(&requests)
+  if err != nil || len(requests) == 0 {
+    w.WriteHeader(http.StatusInternalServerError)
+    w.Write([]byte("invalid request"))
+    return
+  }
+  node.mutex.Lock()
+  node.batches[requests[0].Method] = append(node.batches[requests[0].Method], len(requests))
+  node.mutex.Unlock()
+
+  responses := make([]map[string]interface{}, 0, len(requests))
+  for _, request := range requests {
+    var result interface{}
+    var rpcErr *rpcError
+    if node.fail != nil {
+      rpcErr = node.fail(request.Method, request.Params)
+    }
+    if rpcErr == nil {
+      result, rpcErr = node.result(request.Method, request.Params)
+    }
+    responses = append(responses, map[string]interface{}{"id": request.Id, "result": result, "error": rpcErr})
+  }
+  json.NewEncoder(w).Encode(responses)
+}
+
+func (node *fakeNode) result(method string, params []interface{}) (interface{}, *rpcError) {
+  switch method {
+  case "getblockchaininfo":
+    return map[string]interface{}{"blocks": len(node.blocks) - 1}, nil
+  case "getbestblockhash":
+    return node.hashes[len(node.hashes)-1], nil
+  case "getblockhash":
+    height := int(params[0].(float64))
+    if height < len(node.hashes) {
+      return node.hashes[height], nil
+    }
+  case "getblockheader", "getblock":
+    for i := 0; i < len(node.hashes); i++ {
+      if node.hashes[i] != params[0] {
+        continue
+      }
+      if method == "getblock" {
+        return hex.EncodeToString(node.blocks[i]), nil
+      }
+      return hex.EncodeToString(node.blocks[i][:80]), nil
+    }
+  }
+  return nil, &rpcError{-5, "Block not found"}
+}
+
+// batchSizes returns the sizes of the batches of method and forgets them
+func (node *fakeNode) batchSizes(method string) []int {
+  node.mutex.Lock()
+  defer node.mutex.Unlock()
+  sizes := node.batches[method]
+  delete(node.batches, method)
+  return sizes
+}
+
+func TestHeadersAndBlocks(t *testing.T) {
+  node := newFakeNode(t, 10)
+  source, err := NewRpcBlockSource(node.url(), testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  options := NewRpcBlockSourceDefaultOptions()
+  options.BatchSize = 2
+  options.FetchWorkers = 2
+  source.SetOptions(options)
+
+  chains, err := source.Headers(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 1 || chains[0].Length != 10 || chains[0].Last.Height != 9 {
+    t.Fatalf("Headers %+v", chains)
+  }
+  start := chains[0].First.NextBlockInfo.NextBlockInfo.NextBlockInfo
+
+  chains, err = source.Headers(start)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 1 || chains[0].First != start || chains[0].Length != 7 {
+    t.Fatalf("Headers from height 3 %+v", chains)
+  }
+
+  // blocks are fetched ahead along the chain, one batch per worker
+  node.batchSizes("getblock")
+  for blockInfo := start.NextBlockInfo; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+    block, err := source.Block(blockInfo.Hash)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if block.Hash != blockInfo.Hash || blockInfo.Size != block.Size {
+      t.Fatalf("Block %x for %x", block.Hash, blockInfo.Hash)
+    }
+  }
+  if sizes := node.batchSizes("getblock"); !reflect.DeepEqual(sizes, []int{2, 2, 2}) {
+    t.Errorf("getblock batches %v", sizes)
+  }
+
+  // a block which is not on the active chain any more
+  stale := *start
+  stale.Hash[0] ^= 0xff
+  chains, err = source.Headers(&stale)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chains) != 0 {
+    t.Fatalf("Headers from a stale block %+v", chains)
+  }
+}
+
+func TestRpcErrors(t *testing.T) {
+  node := newFakeNode(t, 4)
+
+  source, err := NewRpcBlockSource(strings.Replace(node.url(), "password", "wrong", 1), testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  _, err = source.Headers(nil)
+  if err == nil || err.Error() != "RPC authorization failed" {
+    t.Errorf("Wrong credentials: %v", err)
+  }
+
+  source, err = NewRpcBlockSource(node.url(), testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  options := NewRpcBlockSourceDefaultOptions()
+  options.BatchSize = 2
+  source.SetOptions(options)
+  chains, err := source.Headers(nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  first := chains[0].First.Hash
+
+  // one failing request fails the batch
+  node.fail = func(method string, params []interface{}) *rpcError {
+    if method == "getblock" && params[0] == node.hashes[3] {
+      return &rpcError{-1, "Block not available (pruned data)"}
+    }
+    return nil
+  }
+  _, err = source.Block(first)
+  if err == nil || err.Error() != "RPC getblock failed: Block not available (pruned data) (-1)" {
+    t.Errorf("Failing getblock: %v", err)
+  }
+
+  // a block not matching the requested hash
+  node.fail = nil
+  node.blocks[2], node.blocks[3] = node.blocks[3], node.blocks[2]
+  _, err = source.Block(first)
+  if err == nil || !strings.HasPrefix(err.Error(), fmt.Sprintf("Got block %s instead of %s", node.hashes[3], node.hashes[2])) {
+    t.Errorf("Wrong block: %v", err)
+  }
+
+  // anything but JSON-RPC responses
+  source, err = NewRpcBlockSource(node.url(), testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  node.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusServiceUnavailable)
+    w.Write([]byte("Loading block index..."))
+  })
+  _, err = source.Headers(nil)
+  if err == nil || err.Error() != "RPC status 503: Loading block index..." {
+    t.Errorf("Unavailable node: %v", err)
+  }
+}
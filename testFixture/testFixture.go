@@ -0,0 +1,84 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package testFixture
+
+import (
+  "encoding/binary"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "testing"
+  "time"
+)
+
+// NewCoinbase returns a coinbase transaction paying value to pkScript. tag
+// makes the transaction unique, so blocks at the same height of different
+// branches do not share their coinbase.
+func NewCoinbase(tag uint32, value int64, pkScript []byte) *wire.MsgTx {
+  tx := wire.NewMsgTx(1)
+  signatureScript := make([]byte, 5)
+  signatureScript[0] = 0x04
+  binary.LittleEndian.PutUint32(signatureScript[1:], tag)
+  tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), signatureScript, nil))
+  tx.AddTxOut(wire.NewTxOut(value, pkScript))
+  return tx
+}
+
+// NewBlock mines a block with txs on top of prev for the target bits.
+// Regtest and other easy targets are met after a few nonces.
+func NewBlock(t testing.TB, prev chainhash.Hash, timestamp int64, bits uint32, txs ...*wire.MsgTx) *wire.MsgBlock {
+  hashes := make([]chainhash.Hash, len(txs))
+  for i := 0; i < len(txs); i++ {
+    hashes[i] = txs[i].TxHash()
+  }
+  for len(hashes) > 1 {
+    if len(hashes)%2 == 1 {
+      hashes = append(hashes, hashes[len(hashes)-1])
+    }
+    next := make([]chainhash.Hash, 0, len(hashes)/2)
+    for i := 0; i < len(hashes); i += 2 {
+      next = append(next, chainhash.DoubleHashH(append(hashes[i][:], hashes[i+1][:]...)))
+    }
+    hashes = next
+  }
+
+  block := wire.NewMsgBlock(wire.NewBlockHeader(1, &prev, &hashes[0], bits, 0))
+  block.Header.Timestamp = time.Unix(timestamp, 0)
+  for i := 0; i < len(txs); i++ {
+    err := block.AddTransaction(txs[i])
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  target := blockchain.CompactToBig(block.Header.Bits)
+  for {
+    hash := block.Header.BlockHash()
+    if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+      return block
+    }
+    block.Header.Nonce++
+  }
+}
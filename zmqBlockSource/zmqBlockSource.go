@@ -0,0 +1,223 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package zmqBlockSource
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/pebbe/zmq4"
+  "omnom/bitcoinBlockchainParser"
+  "omnom/blockSource"
+  "syscall"
+  "time"
+)
+
+const rawBlockTopic = "rawblock"
+
+// ZmqBlockSource receives blocks from bitcoind's zmqpubrawblock endpoint.
+// ZMQ only publishes new blocks, so the initial headers and all blocks which
+// were not published come from base, e.g. the blk files. A published block
+// extending the index tip is served from memory without asking base. Every
+// message carries a sequence number. If one is skipped, a block can not be
+// decoded or its header is invalid, the next Headers catches up from base.
+type ZmqBlockSource struct {
+  endpoint string
+  chainCfg *chaincfg.Params
+  base     blockSource.BlockSource
+  progress bitcoinBlockchainParser.ProgressReporter
+
+  blocks       map[[32]byte]*bitcoinBlockchainParser.Block
+  sequence     uint32
+  haveSequence bool
+  catchUp      bool
+}
+
+// NewZmqBlockSource returns a source for endpoint. progress may be nil.
+func NewZmqBlockSource(endpoint string, chainCfg *chaincfg.Params, base blockSource.BlockSource, progress bitcoinBlockchainParser.ProgressReporter) *ZmqBlockSource {
+  source := new(ZmqBlockSource)
+  source.endpoint = endpoint
+  source.chainCfg = chainCfg
+  source.base = base
+  source.progress = progress
+  source.blocks = make(map[[32]byte]*bitcoinBlockchainParser.Block)
+  return source
+}
+
+// Headers returns the chain from start to a published block whose parent is
+// start. All other chains, and all of them after a missed or undecodable
+// message or an invalid header, come from base.
+func (source *ZmqBlockSource) Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error) {
+  if start != nil && !source.catchUp {
+    for _, block := range source.blocks {
+      if block.PrevHash != start.Hash {
+        continue
+      }
+      chains, err := source.extend(start, block)
+      if err == nil {
+        return chains, nil
+      }
+
+      reason := err.Error()
+      if invalidHeader, ok := err.(*bitcoinBlockchainParser.InvalidHeaderError); ok {
+        reason = invalidHeader.Reason
+      }
+      source.report(bitcoinBlockchainParser.InvalidHeaderEvent{Hash: fmt.Sprintf("%x", block.Hash), Height: start.Height + 1, Reason: reason})
+      delete(source.blocks, block.Hash)
+      source.catchUp = true
+      break
+    }
+  }
+
+  chains, err := source.base.Headers(start)
+  if err != nil {
+    return nil, err
+  }
+  source.catchUp = false
+  return chains, nil
+}
+
+// extend returns the chain of start and the published block following it
+func (source *ZmqBlockSource) extend(start *bitcoinBlockchainParser.BlockInfo, block *bitcoinBlockchainParser.Block) ([]*bitcoinBlockchainParser.Chain, error) {
+  blockInfo := bitcoinBlockchainParser.NewBlockInfoFromBlock(block)
+  blockInfo.Height = start.Height + 1
+  err := bitcoinBlockchainParser.CheckHeader(blockInfo, start, source.chainCfg)
+  if err != nil {
+    return nil, err
+  }
+
+  work := blockchain.CalcWork(blockInfo.Bits)
+  if start.ChainWork != nil {
+    work.Add(work, start.ChainWork)
+  }
+  blockInfo.ChainWork = work
+  blockInfo.PrevBlockInfo = start
+  start.NextBlockInfo = blockInfo
+  start.PartOfChain = true
+  blockInfo.PartOfChain = true
+
+  chain := &bitcoinBlockchainParser.Chain{First: start, Last: blockInfo, Length: 2}
+  return []*bitcoinBlockchainParser.Chain{chain}, nil
+}
+
+// Block returns a published block from memory, all others from base
+func (source *ZmqBlockSource) Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error) {
+  block := source.blocks[hash]
+  if block != nil {
+    delete(source.blocks, hash)
+    return block, nil
+  }
+  return source.base.Block(hash)
+}
+
+// WatchTips subscribes to rawblock messages and handles them until stop is
+// closed
+func (source *ZmqBlockSource) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  source.haveSequence = false
+
+  socket, err := zmq4.NewSocket(zmq4.SUB)
+  if err != nil {
+    return err
+  }
+  defer socket.Close()
+
+  // wake up regularly to check for stop
+  err = socket.SetRcvtimeo(time.Second)
+  if err != nil {
+    return err
+  }
+  err = socket.SetSubscribe(rawBlockTopic)
+  if err != nil {
+    return err
+  }
+  err = socket.Connect(source.endpoint)
+  if err != nil {
+    return err
+  }
+
+  for {
+    select {
+    case <-stop:
+      return nil
+    default:
+    }
+
+    message, err := socket.RecvMessageBytes(0)
+    if zmq4.AsErrno(err) == zmq4.Errno(syscall.EAGAIN) {
+      continue
+    }
+    if err != nil {
+      return err
+    }
+
+    err = source.HandleMessage(message, onNewTip)
+    if err != nil {
+      return err
+    }
+  }
+}
+
+func (source *ZmqBlockSource) Close() error {
+  return source.base.Close()
+}
+
+// HandleMessage handles one multipart message as published by bitcoind:
+// topic, payload and a 4 byte little endian sequence number
+func (source *ZmqBlockSource) HandleMessage(message [][]byte, onNewTip func() error) error {
+  if len(message) != 3 || string(message[0]) != rawBlockTopic || len(message[2]) != 4 {
+    return nil
+  }
+
+  sequence := binary.LittleEndian.Uint32(message[2])
+  if source.haveSequence && sequence != source.sequence+1 {
+    source.report(bitcoinBlockchainParser.MissedNotificationsEvent{Topic: rawBlockTopic, Expected: source.sequence + 1, Sequence: sequence})
+    source.catchUp = true
+  }
+  source.sequence = sequence
+  source.haveSequence = true
+
+  block, err := bitcoinBlockchainParser.DecodeBlock(bytes.NewReader(message[1]), source.chainCfg)
+  if err != nil {
+    source.report(bitcoinBlockchainParser.NotificationDecodeFailureEvent{Topic: rawBlockTopic, Sequence: sequence, Reason: err.Error()})
+    source.catchUp = true
+  } else {
+    source.blocks[block.Hash] = block
+  }
+
+  err = onNewTip()
+
+  // published blocks which were not indexed are not part of the chain
+  source.blocks = make(map[[32]byte]*bitcoinBlockchainParser.Block)
+  return err
+}
+
+// report passes event to the progress reporter, if set
+func (source *ZmqBlockSource) report(event bitcoinBlockchainParser.ProgressEvent) {
+  if source.progress != nil {
+    source.progress.Report(event)
+  }
+}
@@ -0,0 +1,300 @@
+/*
+ * MIT License
+ *
+ * Copyright (c) 2019 schulterklopfer/SKP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILIT * Y, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package zmqBlockSource
+
+import (
+  "bytes"
+  "encoding/binary"
+  "github.com/btcsuite/btcd/blockchain"
+  "github.com/btcsuite/btcd/chaincfg"
+  "github.com/btcsuite/btcd/chaincfg/chainhash"
+  "github.com/btcsuite/btcd/wire"
+  "github.com/pebbe/zmq4"
+  "omnom/bitcoinBlockchainParser"
+  "omnom/testFixture"
+  "sync"
+  "testing"
+  "time"
+)
+
+const testEndpoint = "inproc://zmqBlockSourceTest"
+
+var testChainCfg = &chaincfg.RegressionNetParams
+
+// fakeBase returns the chain from start to the end of its blocks
+type fakeBase struct {
+  blocks  []*bitcoinBlockchainParser.Block
+  headers []*bitcoinBlockchainParser.BlockInfo
+}
+
+func (base *fakeBase) Headers(start *bitcoinBlockchainParser.BlockInfo) ([]*bitcoinBlockchainParser.Chain, error) {
+  base.headers = append(base.headers, start)
+  chain := &bitcoinBlockchainParser.Chain{First: start, Last: start, Length: 1}
+  found := false
+  for _, block := range base.blocks {
+    if block.PrevHash == chain.Last.Hash {
+      found = true
+    }
+    if found {
+      blockInfo := bitcoinBlockchainParser.NewBlockInfoFromBlock(block)
+      blockInfo.Height = chain.Last.Height + 1
+      blockInfo.PrevBlockInfo = chain.Last
+      chain.Last.NextBlockInfo = blockInfo
+      chain.Last = blockInfo
+      chain.Length++
+    }
+  }
+  return []*bitcoinBlockchainParser.Chain{chain}, nil
+}
+
+func (base *fakeBase) Block(hash [32]byte) (*bitcoinBlockchainParser.Block, error) {
+  for _, block := range base.blocks {
+    if block.Hash == hash {
+      return block, nil
+    }
+  }
+  return nil, nil
+}
+
+func (base *fakeBase) WatchTips(onNewTip func() error, stop <-chan struct{}) error {
+  return nil
+}
+
+func (base *fakeBase) Close() error {
+  return nil
+}
+
+// testReporter collects the reported events
+type testReporter struct {
+  mutex  sync.Mutex
+  events []bitcoinBlockchainParser.ProgressEvent
+}
+
+func (r *testReporter) Report(event bitcoinBlockchainParser.ProgressEvent) {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  r.events = append(r.events, event)
+}
+
+func (r *testReporter) names() []string {
+  r.mutex.Lock()
+  defer r.mutex.Unlock()
+  names := make([]string, 0, len(r.events))
+  for _, event := range r.events {
+    names = append(names, event.Name())
+  }
+  return names
+}
+
+// newTestBlocks mines count blocks on top of the regtest genesis block and
+// returns them serialized
+func newTestBlocks(t *testing.T, count int) [][]byte {
+  prev := *testChainCfg.GenesisHash
+  timestamp := testChainCfg.GenesisBlock.Header.Timestamp.Unix()
+  blocks := make([][]byte, 0, count)
+  for i := 0; i < count; i++ {
+    coinbase := testFixture.NewCoinbase(uint32(i), 50, []byte{0x51})
+    block := testFixture.NewBlock(t, prev, timestamp+int64(i+1)*600, testChainCfg.PowLimitBits, coinbase)
+    blocks = append(blocks, serializeTestBlock(t, block))
+    prev = block.BlockHash()
+  }
+  return blocks
+}
+
+// newInvalidTestBlock returns a serialized block on top of prev whose hash
+// is above its target
+func newInvalidTestBlock(t *testing.T, prev *bitcoinBlockchainParser.Block) []byte {
+  coinbase := wire.NewMsgTx(1)
+  coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{0x01, 0xff}, nil))
+  coinbase.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+
+  // Hash is stored in display order
+  var prevHash chainhash.Hash
+  for i := 0; i < 32; i++ {
+    prevHash[i] = prev.Hash[31-i]
+  }
+  merkleRoot := coinbase.TxHash()
+  block := wire.NewMsgBlock(wire.NewBlockHeader(1, &prevHash, &merkleRoot, testChainCfg.PowLimitBits, 0))
+  block.Header.Timestamp = time.Unix(int64(prev.Timestamp)+600, 0)
+  block.AddTransaction(coinbase)
+  target := blockchain.CompactToBig(block.Header.Bits)
+  for {
+    hash := block.Header.BlockHash()
+    if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+      break
+    }
+    block.Header.Nonce++
+  }
+  return serializeTestBlock(t, block)
+}
+
+func serializeTestBlock(t *testing.T, block *wire.MsgBlock) []byte {
+  var buffer bytes.Buffer
+  err := block.Serialize(&buffer)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return buffer.Bytes()
+}
+
+func decodeTestBlock(t *testing.T, data []byte) *bitcoinBlockchainParser.Block {
+  block, err := bitcoinBlockchainParser.DecodeBlock(bytes.NewReader(data), testChainCfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return block
+}
+
+func TestWatchTips(t *testing.T) {
+  data := newTestBlocks(t, 4)
+  blocks := make([]*bitcoinBlockchainParser.Block, 0, len(data))
+  for _, d := range data {
+    blocks = append(blocks, decodeTestBlock(t, d))
+  }
+  invalid := newInvalidTestBlock(t, blocks[3])
+
+  genesis := bitcoinBlockchainParser.NewBlockInfoFromBlock(decodeTestBlock(t, serializeTestBlock(t, testChainCfg.GenesisBlock)))
+
+  publisher, err := zmq4.NewSocket(zmq4.XPUB)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer publisher.Close()
+  err = publisher.SetRcvtimeo(5 * time.Second)
+  if err != nil {
+    t.Fatal(err)
+  }
+  err = publisher.Bind(testEndpoint)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  base := &fakeBase{blocks: blocks[:3]}
+  reporter := new(testReporter)
+  source := NewZmqBlockSource(testEndpoint, testChainCfg, base, reporter)
+
+  // like Sync, index the blocks after the tip
+  tip := genesis
+  tips := make(chan [32]byte)
+  onNewTip := func() error {
+    chains, err := source.Headers(tip)
+    if err != nil {
+      return err
+    }
+    for blockInfo := chains[0].First.NextBlockInfo; blockInfo != nil; blockInfo = blockInfo.NextBlockInfo {
+      block, err := source.Block(blockInfo.Hash)
+      if err != nil {
+        return err
+      }
+      if block == nil || block.Hash != blockInfo.Hash {
+        t.Errorf("Block %x not returned", blockInfo.Hash)
+      }
+      tip = blockInfo
+    }
+    tips <- tip.Hash
+    return nil
+  }
+
+  stop := make(chan struct{})
+  done := make(chan error)
+  go func() {
+    done <- source.WatchTips(onNewTip, stop)
+  }()
+
+  // an XPUB socket receives the subscription once the subscriber connected
+  subscription, err := publisher.RecvBytes(0)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if string(subscription) != "\x01"+rawBlockTopic {
+    t.Fatalf("Subscription %q", subscription)
+  }
+
+  publish := func(payload []byte, sequence uint32) [32]byte {
+    sequenceBytes := make([]byte, 4)
+    binary.LittleEndian.PutUint32(sequenceBytes, sequence)
+    _, err := publisher.SendMessage(rawBlockTopic, payload, sequenceBytes)
+    if err != nil {
+      t.Fatal(err)
+    }
+    select {
+    case hash := <-tips:
+      return hash
+    case <-time.After(5 * time.Second):
+      t.Fatal("No new tip")
+    }
+    return [32]byte{}
+  }
+
+  // blocks extending the tip do not need base
+  if hash := publish(data[0], 7); hash != blocks[0].Hash {
+    t.Errorf("Tip %x, expected %x", hash, blocks[0].Hash)
+  }
+  if len(base.headers) != 0 {
+    t.Errorf("Base was asked for %d headers", len(base.headers))
+  }
+
+  // a gap catches up from the tip
+  if hash := publish(data[2], 9); hash != blocks[2].Hash {
+    t.Errorf("Tip %x, expected %x", hash, blocks[2].Hash)
+  }
+  if len(base.headers) != 1 || base.headers[0].Hash != blocks[0].Hash {
+    t.Errorf("Base was asked for %d headers", len(base.headers))
+  }
+
+  // so does a block which can not be decoded
+  if hash := publish([]byte{1, 2, 3}, 10); hash != blocks[2].Hash {
+    t.Errorf("Tip %x, expected %x", hash, blocks[2].Hash)
+  }
+  if len(base.headers) != 2 || base.headers[1].Hash != blocks[2].Hash {
+    t.Errorf("Base was asked for %d headers", len(base.headers))
+  }
+
+  if hash := publish(data[3], 11); hash != blocks[3].Hash {
+    t.Errorf("Tip %x, expected %x", hash, blocks[3].Hash)
+  }
+  if len(base.headers) != 2 {
+    t.Errorf("Base was asked for %d headers", len(base.headers))
+  }
+
+  // and a block extending the tip whose header is invalid
+  if hash := publish(invalid, 12); hash != blocks[3].Hash {
+    t.Errorf("Tip %x, expected %x", hash, blocks[3].Hash)
+  }
+  if len(base.headers) != 3 || base.headers[2].Hash != blocks[3].Hash {
+    t.Errorf("Base was asked for %d headers", len(base.headers))
+  }
+
+  close(stop)
+  err = <-done
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  names := reporter.names()
+  if len(names) != 3 || names[0] != "missed_notifications" || names[1] != "notification_decode_failure" || names[2] != "invalid_header" {
+    t.Errorf("Events %v", names)
+  }
+}